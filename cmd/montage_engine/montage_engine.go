@@ -50,6 +50,11 @@ func main() {
 	// OSC is used for simpler script-driven APIs that don't need results
 	go engine.StartOSCListener("127.0.0.1:3333")
 
+	// HTTP is used for APIs that need results, without needing NATS
+	if httpaddr := engine.ConfigValue("httpaddr"); httpaddr != "" {
+		go engine.StartHTTPServer(httpaddr)
+	}
+
 	go engine.StartMIDI()
 	go engine.StartRealtime()
 	go engine.StartGestureInput()
@@ -61,6 +66,7 @@ func main() {
 	case true:
 		gui.RegisterToolType("Console", tools.NewConsole)
 		gui.RegisterToolType("Riff", tools.NewRiff)
+		gui.RegisterToolType("Layout", tools.NewLayout)
 		gui.Run() // this never returns
 		log.Printf("Montage_Engine: GUI has exited!?\n")
 	case false:
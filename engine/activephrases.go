@@ -1,12 +1,14 @@
 package engine
 
 import (
+	"fmt"
 	"log"
 	"sync"
 )
 
 // ActivePhrase is a currently active MIDI phrase
 type ActivePhrase struct {
+	cid             string
 	phrase          *Phrase
 	clickSoFar      Clicks
 	nextnote        *Note
@@ -18,6 +20,8 @@ type ActivePhrasesManager struct {
 	ActivePhrasesMutex sync.RWMutex
 	activePhrases      map[string]*ActivePhrase // map of cursor ids to ActivePhrases
 	outputCallbacks    []*NoteOutputCallback
+	sendNote           func(n *Note) // if nil, MIDI.SendNote is used
+	lastOneShot        int
 }
 
 // NewActivePhrase constructs a new ActivePhrase for a Phrase
@@ -47,7 +51,7 @@ func (a *ActivePhrase) start() {
 
 // sendNoteOffs returns true if all of the pending notes and notesoff have been processed,
 // i.e. the ActivePhrase can be removed
-func (a *ActivePhrase) sendNoteOffs(due Clicks, debug bool, callbacks []*NoteOutputCallback) bool {
+func (a *ActivePhrase) sendNoteOffs(due Clicks, debug bool, mgr *ActivePhrasesManager) bool {
 
 	if a.phrase == nil {
 		log.Printf("ActivePhrase.sendNoteOffs got unexpected nil phrase value\n")
@@ -58,7 +62,10 @@ func (a *ActivePhrase) sendNoteOffs(due Clicks, debug bool, callbacks []*NoteOut
 	ntoff := a.pendingNoteOffs.firstnote
 	for ; ntoff != nil && ntoff.EndOf() < due; ntoff = ntoff.next {
 
-		MIDI.SendNote(ntoff)
+		mgr.send(ntoff)
+		for _, cb := range mgr.outputCallbacks {
+			cb.Callback(a.cid, ntoff)
+		}
 
 		// Remove it from the notesDown phrase
 		a.pendingNoteOffs.firstnote = ntoff.next
@@ -83,11 +90,35 @@ func (mgr *ActivePhrasesManager) StartPhrase(p *Phrase, cid string) {
 		}
 		active.phrase = p
 	}
+	active.cid = cid
 	active.nextnote = p.firstnote // might be nil
 	mgr.activePhrases[cid] = active
 	active.start()
 }
 
+// StartOneShot starts a Phrase that nothing else will stop,
+// e.g. notes with a fixed duration.  If cid is non-empty, any Phrase
+// already playing with that cid is stopped first (e.g. for choke groups).
+// Unlike StartPhrase, it grabs the ActivePhrasesMutex itself.
+func (mgr *ActivePhrasesManager) StartOneShot(p *Phrase, cid string) {
+	mgr.ActivePhrasesMutex.Lock()
+	defer mgr.ActivePhrasesMutex.Unlock()
+	if cid == "" {
+		mgr.lastOneShot++
+		cid = fmt.Sprintf("oneshot%d", mgr.lastOneShot)
+	}
+	mgr.StartPhrase(p, cid)
+}
+
+// send sends a Note to MIDI output
+func (mgr *ActivePhrasesManager) send(n *Note) {
+	if mgr.sendNote != nil {
+		mgr.sendNote(n)
+	} else {
+		MIDI.SendNote(n)
+	}
+}
+
 // StopPhrase xxx
 // NOTE: stopPhrase assumes that the r.activePhrasesMutex is held for writing
 func (mgr *ActivePhrasesManager) StopPhrase(cid string, active *ActivePhrase, forceDelete bool) {
@@ -103,7 +134,7 @@ func (mgr *ActivePhrasesManager) StopPhrase(cid string, active *ActivePhrase, fo
 		}
 	}
 
-	readyToDelete := active.sendNoteOffs(MaxClicks, DebugUtil.MIDI, mgr.outputCallbacks)
+	readyToDelete := active.sendNoteOffs(MaxClicks, DebugUtil.MIDI, mgr)
 	if readyToDelete || forceDelete {
 		delete(mgr.activePhrases, cid)
 	}
@@ -115,11 +146,12 @@ type CallbackID int
 // NoteOutputCallback is a call
 type NoteOutputCallback struct {
 	id       CallbackID
-	Callback func(n *Note)
+	Callback NoteOutputCallbackFunc
 }
 
-// NoteOutputCallbackFunc xxx
-type NoteOutputCallbackFunc func(n *Note)
+// NoteOutputCallbackFunc is called with each note that's output,
+// and the cid of the ActivePhrase that played it
+type NoteOutputCallbackFunc func(cid string, n *Note)
 
 // UncallbackOnOutput xxx
 func (mgr *ActivePhrasesManager) UncallbackOnOutput(id CallbackID) {
@@ -155,7 +187,7 @@ func (mgr *ActivePhrasesManager) AdvanceByOneClick() {
 	for id, a := range mgr.activePhrases {
 		if a.phrase == nil {
 			log.Printf("advanceactivePhrases, unexpected phrase is nil for id=%s?  deleting it\n", id)
-			if a.sendNoteOffs(MaxClicks, DebugUtil.MIDI, mgr.outputCallbacks) {
+			if a.sendNoteOffs(MaxClicks, DebugUtil.MIDI, mgr) {
 				delete(mgr.activePhrases, id)
 			}
 			continue
@@ -172,10 +204,15 @@ func (mgr *ActivePhrasesManager) AdvanceByOneClick() {
 			case NOTE:
 				nd := n.Copy()
 				nd.TypeOf = NOTEON
-				MIDI.SendNote(nd)
+				mgr.send(nd)
+				for _, cb := range mgr.outputCallbacks {
+					cb.Callback(a.cid, nd)
+				}
 				nd.TypeOf = NOTEOFF
 				nd.Clicks = n.EndOf()
 				a.pendingNoteOffs.InsertNote(nd)
+			case CONTROLLER, PROGCHANGE, CHANPRESSURE, PITCHBEND, NOTEBYTES:
+				mgr.send(n)
 			default:
 				log.Printf("advanceActivePhrase unable to handle n.Typeof=%d n=%s\n", n.TypeOf, n)
 			}
@@ -185,7 +222,7 @@ func (mgr *ActivePhrasesManager) AdvanceByOneClick() {
 
 		// Send whatever NOTEOFFs are due to be sent, and if everything has
 		// been processed, delete it from the activePhrases
-		if a.sendNoteOffs(a.clickSoFar, DebugUtil.MIDI, mgr.outputCallbacks) {
+		if a.sendNoteOffs(a.clickSoFar, DebugUtil.MIDI, mgr) {
 			delete(mgr.activePhrases, id)
 		}
 		a.clickSoFar++
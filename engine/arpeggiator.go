@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// arpHeld is a note being held down in the arpeggiator
+type arpHeld struct {
+	pitch    uint8
+	velocity uint8
+	order    int // when it was pressed, for "asplayed"
+}
+
+// Arpeggiator plays the notes held down in a region (by gestures
+// or MIDI thru) as a pattern, at a rate synced to oneBeat.
+type Arpeggiator struct {
+	mutex   sync.Mutex
+	held    map[string]*arpHeld // key is the gesture id, or "midi" + pitch
+	order   int
+	step    int
+	playing *Note // the NOTEON currently sounding, if any
+	offAt   Clicks
+}
+
+// NewArpeggiator makes a new Arpeggiator
+func NewArpeggiator() *Arpeggiator {
+	return &Arpeggiator{
+		held: make(map[string]*arpHeld),
+	}
+}
+
+// arpRateClicks returns the number of clicks in each step of the arpeggio
+func arpRateClicks(rate string) Clicks {
+	switch rate {
+	case "1/1":
+		return oneBeat * 4
+	case "1/2":
+		return oneBeat * 2
+	case "1/4":
+		return oneBeat
+	case "1/8":
+		return oneBeat / 2
+	case "1/8t":
+		return oneBeat / 3
+	case "1/16t":
+		return oneBeat / 6
+	case "1/32":
+		return oneBeat / 8
+	default: // "1/16"
+		return oneBeat / 4
+	}
+}
+
+// hold adds (or replaces) a held note
+func (arp *Arpeggiator) hold(id string, pitch uint8, velocity uint8) {
+	arp.mutex.Lock()
+	defer arp.mutex.Unlock()
+	h, ok := arp.held[id]
+	if !ok {
+		h = &arpHeld{order: arp.order}
+		arp.order++
+		arp.held[id] = h
+	}
+	h.pitch = pitch
+	h.velocity = velocity
+}
+
+// release removes a held note
+func (arp *Arpeggiator) release(id string) {
+	arp.mutex.Lock()
+	defer arp.mutex.Unlock()
+	delete(arp.held, id)
+	if len(arp.held) == 0 {
+		arp.step = 0
+	}
+}
+
+// releaseChord removes the held notes of the chord of a gesture
+func (arp *Arpeggiator) releaseChord(id string) {
+	arp.mutex.Lock()
+	defer arp.mutex.Unlock()
+	prefix := id + "."
+	for k := range arp.held {
+		if strings.HasPrefix(k, prefix) {
+			delete(arp.held, k)
+		}
+	}
+	if len(arp.held) == 0 {
+		arp.step = 0
+	}
+}
+
+// clear removes all held notes, and returns the NOTEON (if any)
+// that needs to be turned off
+func (arp *Arpeggiator) clear() *Note {
+	arp.mutex.Lock()
+	defer arp.mutex.Unlock()
+	arp.held = make(map[string]*arpHeld)
+	arp.step = 0
+	n := arp.playing
+	arp.playing = nil
+	return n
+}
+
+// pattern returns the held notes, in the order given by mode
+// and expanded over the given number of octaves
+func (arp *Arpeggiator) pattern(mode string, octaves int) []arpHeld {
+	base := make([]arpHeld, 0, len(arp.held))
+	for _, h := range arp.held {
+		base = append(base, *h)
+	}
+	if mode == "asplayed" {
+		sort.Slice(base, func(i, j int) bool { return base[i].order < base[j].order })
+	} else {
+		sort.Slice(base, func(i, j int) bool { return base[i].pitch < base[j].pitch })
+	}
+	notes := make([]arpHeld, 0, len(base)*octaves)
+	for oct := 0; oct < octaves; oct++ {
+		for _, h := range base {
+			p := int(h.pitch) + 12*oct
+			if p > 127 {
+				continue
+			}
+			h.pitch = uint8(p)
+			notes = append(notes, h)
+		}
+	}
+	switch mode {
+	case "down":
+		for i, j := 0, len(notes)-1; i < j; i, j = i+1, j-1 {
+			notes[i], notes[j] = notes[j], notes[i]
+		}
+	case "updown":
+		// Go back down without repeating the top and bottom notes
+		for i := len(notes) - 2; i > 0; i-- {
+			notes = append(notes, notes[i])
+		}
+	}
+	return notes
+}
+
+// advance is called on every click, and returns the NOTEOFF and NOTEON
+// (either of which can be nil) that should be sent on this click
+func (arp *Arpeggiator) advance(clk Clicks, mode string, rate string, octaves int, gate float32, synth string) (noteOff *Note, noteOn *Note) {
+
+	arp.mutex.Lock()
+	defer arp.mutex.Unlock()
+
+	if arp.playing != nil && clk >= arp.offAt {
+		noteOff = NewNoteOff(arp.playing.Pitch, arp.playing.Velocity, arp.playing.Sound)
+		arp.playing = nil
+	}
+
+	if len(arp.held) == 0 {
+		return noteOff, nil
+	}
+
+	stepClicks := arpRateClicks(rate)
+	if stepClicks < 1 {
+		stepClicks = 1
+	}
+	if clk%stepClicks != 0 {
+		return noteOff, nil
+	}
+
+	if octaves < 1 {
+		octaves = 1
+	}
+	notes := arp.pattern(mode, octaves)
+	if len(notes) == 0 {
+		return noteOff, nil
+	}
+
+	var h arpHeld
+	if mode == "random" {
+		h = notes[rand.Intn(len(notes))]
+	} else {
+		h = notes[arp.step%len(notes)]
+	}
+	arp.step++
+
+	// If the previous note is still sounding (i.e. gate is 1.0), end it now
+	if arp.playing != nil {
+		noteOff = NewNoteOff(arp.playing.Pitch, arp.playing.Velocity, arp.playing.Sound)
+	}
+
+	gateClicks := Clicks(float32(stepClicks) * gate)
+	if gateClicks < 1 {
+		gateClicks = 1
+	}
+	if DebugUtil.MIDI {
+		log.Printf("Arpeggiator.advance: clk=%d pitch=%d gate=%d\n", clk, h.pitch, gateClicks)
+	}
+	arp.playing = NewNoteOn(h.pitch, h.velocity, synth)
+	arp.offAt = clk + gateClicks
+	return noteOff, arp.playing
+}
+
+// arpeggiating returns true if the arpeggiator is on
+func (r *Reactor) arpeggiating() bool {
+	mode := r.params.ParamStringValue("sound.arpmode", "off")
+	return mode != "off" && mode != ""
+}
+
+// advanceArpeggiator is called on every click
+func (r *Reactor) advanceArpeggiator(clk Clicks) {
+	if !r.arpeggiating() {
+		// Make sure nothing is left sounding when it's turned off
+		if n := r.arpeggiator.clear(); n != nil {
+			r.sendNoteOff(&ActiveNote{noteOn: n})
+		}
+		return
+	}
+	noteOff, noteOn := r.arpeggiator.advance(clk,
+		r.params.ParamStringValue("sound.arpmode", "up"),
+		r.params.ParamStringValue("sound.arprate", "1/16"),
+		r.params.ParamIntValue("sound.arpoctaves"),
+		r.params.ParamFloatValue("sound.arpgate"),
+		r.params.ParamStringValue("sound.synth", defaultSynth))
+	if noteOff != nil {
+		if DebugUtil.MIDI {
+			log.Printf("MIDI.SendNote: noteOff=%+v\n", *noteOff)
+		}
+		r.sendNote(noteOff)
+	}
+	if noteOn != nil {
+		r.lastActiveID++
+		r.sendNoteOn(&ActiveNote{id: r.lastActiveID, noteOn: noteOn})
+	}
+}
+
+// clearArpeggiator releases all the held notes
+func (r *Reactor) clearArpeggiator() {
+	if n := r.arpeggiator.clear(); n != nil {
+		r.sendNoteOff(&ActiveNote{noteOn: n})
+	}
+}
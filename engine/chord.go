@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// Chord is a list of scale steps above the root of a chord,
+// e.g. [0,2,4] is a triad and [0,4,9] is an open triad.
+// The root (0) doesn't need to be included.
+type Chord []int
+
+// Chords maps a name to a Chord
+var Chords map[string]Chord
+
+// LoadChords reads the chord definitions in chords.json
+func LoadChords() error {
+
+	Chords = make(map[string]Chord)
+
+	path := ConfigFilePath("chords.json")
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("LoadChords: unable to read path=%s", path)
+	}
+	var f struct {
+		Chords map[string]Chord `json:"chords"`
+	}
+	err = json.Unmarshal(bytes, &f)
+	if err != nil {
+		return fmt.Errorf("LoadChords: unable to Unmarshal path=%s, err=%s", path, err)
+	}
+	for nm, c := range f.Chords {
+		Chords[nm] = c
+	}
+	return nil
+}
+
+// chordPitches returns the pitches (other than the root) of a chord
+// built on root, using the steps of a scale.  spread is the number
+// of octaves by which every other chord tone is raised.
+func chordPitches(chord Chord, scale *Scale, root uint8, spread int) []uint8 {
+	pitches := make([]uint8, 0, len(chord))
+	for i, steps := range chord {
+		if steps == 0 {
+			continue
+		}
+		p, ok := scale.StepsAbove(root, steps)
+		if !ok {
+			continue
+		}
+		pitch := int(p)
+		if i%2 == 1 {
+			pitch += 12 * spread
+		}
+		if pitch > 127 {
+			continue
+		}
+		pitches = append(pitches, uint8(pitch))
+	}
+	return pitches
+}
+
+// cursorToChordNotes returns the NOTEONs (other than the one for the root)
+// of the chord played by a gesture, or nil if sound.chord is "none"
+func (r *Reactor) cursorToChordNotes(ce GestureStepEvent, root *Note) []*Note {
+	name := r.params.ParamStringValue("sound.chord", "none")
+	if name == "none" || name == "" {
+		return nil
+	}
+	chord, ok := Chords[name]
+	if !ok {
+		log.Printf("cursorToChordNotes: no chord named %s\n", name)
+		return nil
+	}
+
+	// The spread comes from the y or z value of the gesture
+	var v float32
+	switch r.params.ParamStringValue("sound.chordspread", "none") {
+	case "y":
+		v = ce.Y
+	case "z":
+		v = ce.Z
+	}
+	spread := int(v*2.0 + 0.5)
+
+	// The chord is built from the untransposed pitch, which is in the scale
+	base := int(root.Pitch) - r.TransposePitch
+	if base < 0 || base > 127 {
+		return nil
+	}
+	var notes []*Note
+	for _, p := range chordPitches(chord, r.getScale(), uint8(base), spread) {
+		pitch := int(p) + r.TransposePitch
+		if pitch < 0 || pitch > 127 {
+			continue
+		}
+		notes = append(notes, NewNoteOn(uint8(pitch), root.Velocity, root.Sound))
+	}
+	return notes
+}
@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/vizicist/portmidi"
+)
+
+// chordQuality is a kind of chord that can be recognized,
+// and the scale that goes with it.  Both are in semitones above the root.
+type chordQuality struct {
+	name   string
+	chord  []int
+	scale  []int
+	weight int // when several qualities match, the higher weight wins
+}
+
+var chordQualities = []chordQuality{
+	{"maj", []int{0, 4, 7}, []int{0, 2, 4, 5, 7, 9, 11}, 10},
+	{"min", []int{0, 3, 7}, []int{0, 2, 3, 5, 7, 9, 10}, 10},
+	{"7", []int{0, 4, 7, 10}, []int{0, 2, 4, 5, 7, 9, 10}, 9},
+	{"maj7", []int{0, 4, 7, 11}, []int{0, 2, 4, 5, 7, 9, 11}, 9},
+	{"min7", []int{0, 3, 7, 10}, []int{0, 2, 3, 5, 7, 9, 10}, 9},
+	{"minmaj7", []int{0, 3, 7, 11}, []int{0, 2, 3, 5, 7, 9, 11}, 7},
+	{"6", []int{0, 4, 7, 9}, []int{0, 2, 4, 5, 7, 9, 11}, 6},
+	{"min6", []int{0, 3, 7, 9}, []int{0, 2, 3, 5, 7, 9, 10}, 6},
+	{"m7b5", []int{0, 3, 6, 10}, []int{0, 1, 3, 5, 6, 8, 10}, 8},
+	{"dim", []int{0, 3, 6}, []int{0, 1, 3, 5, 6, 8, 10}, 8},
+	{"dim7", []int{0, 3, 6, 9}, []int{0, 2, 3, 5, 6, 8, 9, 11}, 8},
+	{"aug", []int{0, 4, 8}, []int{0, 2, 4, 6, 8, 10}, 7},
+	{"sus4", []int{0, 5, 7}, []int{0, 2, 4, 5, 7, 9, 10}, 7},
+	{"sus2", []int{0, 2, 7}, []int{0, 2, 4, 5, 7, 9, 11}, 6},
+	{"7sus4", []int{0, 5, 7, 10}, []int{0, 2, 4, 5, 7, 9, 10}, 6},
+	{"9", []int{0, 2, 4, 7, 10}, []int{0, 2, 4, 5, 7, 9, 10}, 5},
+	{"maj9", []int{0, 2, 4, 7, 11}, []int{0, 2, 4, 5, 7, 9, 11}, 5},
+	{"min9", []int{0, 2, 3, 7, 10}, []int{0, 2, 3, 5, 7, 9, 10}, 5},
+	{"5", []int{0, 7}, []int{0, 2, 3, 5, 7, 9, 10}, 1},
+}
+
+// RecognizedChord is the result of chord recognition
+type RecognizedChord struct {
+	Root    string `json:"root"` // e.g. "C#"
+	Quality string `json:"quality"`
+	Notes   []int  `json:"notes"`
+	root    int
+	scale   []int
+}
+
+// Scale returns the scale that goes with a recognized chord
+func (c *RecognizedChord) Scale() *Scale {
+	pitches := make([]int, len(c.scale))
+	for i, p := range c.scale {
+		pitches[i] = (p + c.root) % 12
+	}
+	return makeScale(pitches...)
+}
+
+// RecognizeChord identifies the root and quality of a set of pitches.
+// Every chord tone has to be present, and the chord with the fewest
+// pitches left over wins, preferring the lowest pitch as the root.
+func RecognizeChord(pitches []int) (*RecognizedChord, bool) {
+	if len(pitches) < 2 {
+		return nil, false
+	}
+	var has [12]bool
+	npc := 0
+	bass := 128
+	for _, p := range pitches {
+		if !has[p%12] {
+			has[p%12] = true
+			npc++
+		}
+		if p < bass {
+			bass = p
+		}
+	}
+
+	var best *chordQuality
+	bestRoot := 0
+	bestScore := -1
+	for root := 0; root < 12; root++ {
+		if !has[root] {
+			continue
+		}
+		for i := range chordQualities {
+			q := &chordQualities[i]
+			matched := true
+			for _, interval := range q.chord {
+				if !has[(root+interval)%12] {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			// Pitches that aren't in the chord count heavily against it
+			extra := npc - len(q.chord)
+			score := 100*len(q.chord) - 150*extra + q.weight
+			if root == bass%12 {
+				score += 20
+			}
+			if score > bestScore {
+				bestScore = score
+				best = q
+				bestRoot = root
+			}
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	notes := append([]int{}, pitches...)
+	sort.Ints(notes)
+	return &RecognizedChord{
+		Root:    KeyNames[bestRoot],
+		Quality: best.name,
+		Notes:   notes,
+		root:    bestRoot,
+		scale:   best.scale,
+	}, true
+}
+
+// ChordRecognizer follows the notes held on a MIDI keyboard
+// (or played by a MIDI file) and sets the external scale
+// of all regions from the chord they make.
+type ChordRecognizer struct {
+	mutex          sync.Mutex
+	held           map[string]map[int]int // source is the key, then pitch, value is the number of NOTEONs
+	current        *RecognizedChord
+	Latch          bool // if true, the scale is kept until the next chord
+	FollowMIDIFile bool // if true, notes played by MIDI files are followed
+}
+
+// NewChordRecognizer makes a new ChordRecognizer
+func NewChordRecognizer() *ChordRecognizer {
+	return &ChordRecognizer{
+		held:  make(map[string]map[int]int),
+		Latch: true,
+	}
+}
+
+// Current returns the most recently recognized chord, or nil
+func (cr *ChordRecognizer) Current() *RecognizedChord {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.current
+}
+
+// SetLatch turns latching on or off
+func (cr *ChordRecognizer) SetLatch(onoff bool) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.Latch = onoff
+}
+
+// SetFollowMIDIFile turns following of MIDI files on or off
+func (cr *ChordRecognizer) SetFollowMIDIFile(onoff bool) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.FollowMIDIFile = onoff
+	cr.held = make(map[string]map[int]int)
+}
+
+// following returns true if MIDI files are being followed
+func (cr *ChordRecognizer) following() bool {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.FollowMIDIFile
+}
+
+// noteEvent updates the held notes, and returns the new chord if it changed.
+// The same keyboard can be routed to several regions, so notes are
+// held per source and a pitch is in the chord if any source holds it.
+// cleared is true if the regions should go back to their own scales.
+func (cr *ChordRecognizer) noteEvent(source string, pitch int, down bool) (chord *RecognizedChord, cleared bool) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	held, ok := cr.held[source]
+	if !ok {
+		held = make(map[int]int)
+		cr.held[source] = held
+	}
+	if down {
+		held[pitch]++
+	} else if held[pitch] > 0 {
+		held[pitch]--
+		if held[pitch] == 0 {
+			delete(held, pitch)
+		}
+	}
+
+	// When latched, the chord only changes when a note goes down
+	if cr.Latch && !down {
+		return nil, false
+	}
+
+	pitches := make([]int, 0)
+	for p := 0; p < 128; p++ {
+		for _, h := range cr.held {
+			if h[p] > 0 {
+				pitches = append(pitches, p)
+				break
+			}
+		}
+	}
+	c, ok := RecognizeChord(pitches)
+	if !ok {
+		if !cr.Latch && len(pitches) == 0 && cr.current != nil {
+			cr.current = nil
+			return nil, true
+		}
+		return nil, false
+	}
+	if cr.current != nil && c.root == cr.current.root && c.Quality == cr.current.Quality {
+		cr.current = c
+		return nil, false
+	}
+	cr.current = c
+	return c, false
+}
+
+// handleChordNote feeds a NOTEON or NOTEOFF to the chord recognizer,
+// and sets the external scale of all regions when the chord changes
+func (r *Router) handleChordNote(source string, pitch int, down bool) {
+	chord, cleared := r.chordRecognizer.noteEvent(source, pitch, down)
+	if chord == nil && !cleared {
+		return
+	}
+	if DebugUtil.MIDI {
+		log.Printf("Router.handleChordNote: chord=%+v cleared=%v\n", chord, cleared)
+	}
+	for _, reactor := range r.reactors {
+		if cleared {
+			reactor.useExternalScale = false
+			continue
+		}
+		// Each region gets its own copy, since "setscale" changes it in place
+		reactor.externalScale = chord.Scale()
+		reactor.useExternalScale = true
+	}
+}
+
+// followMIDIFileNote is called for every note a region's MIDI file plays
+func (r *Router) followMIDIFileNote(reactor *Reactor, n *Note) {
+	if !r.chordRecognizer.following() {
+		return
+	}
+	// Drums on channel 10 aren't part of the harmony
+	if n.Sound == "channel10" {
+		return
+	}
+	source := "midifile" + reactor.padName
+	switch n.TypeOf {
+	case NOTEON:
+		r.handleChordNote(source, int(n.Pitch), n.Velocity > 0)
+	case NOTEOFF:
+		r.handleChordNote(source, int(n.Pitch), false)
+	}
+}
+
+// handleMIDISetChordNote is used when MIDIThru is "setchord"
+func (r *Reactor) handleMIDISetChordNote(e portmidi.Event) {
+	status := e.Status & 0xf0
+	switch {
+	case status == 0x90 && e.Data2 > 0:
+		TheRouter().handleChordNote(r.padName, int(e.Data1), true)
+	case status == 0x80 || status == 0x90:
+		TheRouter().handleChordNote(r.padName, int(e.Data1), false)
+	}
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// DrumPad is one cell of a DrumKit
+type DrumPad struct {
+	Col      int     `json:"col"`
+	Row      int     `json:"row"` // row 0 is at the bottom
+	Name     string  `json:"name"`
+	Pitch    int     `json:"pitch"`
+	Synth    string  `json:"synth"`    // if empty, the kit's synth is used
+	Duration float32 `json:"duration"` // in beats, if 0 the kit's duration is used
+	Choke    string  `json:"choke"`    // pads in the same choke group cut each other off
+}
+
+// DrumKit is the layout of a region used as drum pads,
+// as found in a presets/drumpads file
+type DrumKit struct {
+	Cols     int        `json:"cols"`
+	Rows     int        `json:"rows"`
+	Synth    string     `json:"synth"`    // if empty, the region's sound.synth is used
+	Duration float32    `json:"duration"` // in beats, if 0 sound.duration is used
+	Pads     []*DrumPad `json:"pads"`
+}
+
+// drummer caches the DrumKit of a Reactor
+type drummer struct {
+	mutex sync.Mutex
+	name  string
+	kit   *DrumKit
+}
+
+// LoadDrumKit reads a drumpads preset
+func LoadDrumKit(path string) (*DrumKit, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadDrumKit: unable to read path=%s", path)
+	}
+	var kit DrumKit
+	err = json.Unmarshal(bytes, &kit)
+	if err != nil {
+		return nil, fmt.Errorf("LoadDrumKit: unable to Unmarshal path=%s, err=%s", path, err)
+	}
+	if kit.Cols < 1 || kit.Rows < 1 {
+		return nil, fmt.Errorf("LoadDrumKit: invalid cols/rows in path=%s", path)
+	}
+	for _, pad := range kit.Pads {
+		if pad.Col < 0 || pad.Col >= kit.Cols || pad.Row < 0 || pad.Row >= kit.Rows {
+			return nil, fmt.Errorf("LoadDrumKit: pad %s is outside the grid in path=%s", pad.Name, path)
+		}
+		if pad.Pitch < 0 || pad.Pitch > 127 {
+			return nil, fmt.Errorf("LoadDrumKit: pad %s has invalid pitch %d", pad.Name, pad.Pitch)
+		}
+	}
+	return &kit, nil
+}
+
+// padAt returns the pad at col,row, or nil if the cell is empty
+func (kit *DrumKit) padAt(col, row int) *DrumPad {
+	for _, pad := range kit.Pads {
+		if pad.Col == col && pad.Row == row {
+			return pad
+		}
+	}
+	return nil
+}
+
+// getDrumKit returns the DrumKit named by sound.drumpads, or nil
+func (r *Reactor) getDrumKit() *DrumKit {
+	name := r.params.ParamStringValue("sound.drumpads", "")
+	d := r.drummer
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if name == d.name {
+		return d.kit
+	}
+	d.name = name
+	d.kit = nil
+	if name == "" {
+		return nil
+	}
+	kit, err := LoadDrumKit(PresetFilePath("drumpads", name))
+	if err != nil {
+		log.Printf("Reactor.getDrumKit: region=%s err=%s\n", r.padName, err)
+		return nil
+	}
+	d.kit = kit
+	return kit
+}
+
+// playDrumPad triggers the pad under a gesture, when misc.logic_sound is "drumpads"
+func (r *Reactor) playDrumPad(ce GestureStepEvent) {
+	if ce.Downdragup != "down" {
+		return
+	}
+	kit := r.getDrumKit()
+	if kit == nil {
+		return
+	}
+	col := clampInt(int(ce.X*float32(kit.Cols)), 0, kit.Cols-1)
+	row := clampInt(int(ce.Y*float32(kit.Rows)), 0, kit.Rows-1)
+	pad := kit.padAt(col, row)
+	if pad == nil {
+		return
+	}
+
+	synth := pad.Synth
+	if synth == "" {
+		synth = kit.Synth
+	}
+	if synth == "" {
+		synth = r.params.ParamStringValue("sound.synth", defaultSynth)
+	}
+	beats := pad.Duration
+	if beats <= 0 {
+		beats = kit.Duration
+	}
+	if beats <= 0 {
+		beats = r.params.ParamFloatValue("sound.duration")
+	}
+	duration := Clicks(beats*float32(oneBeat) + 0.5)
+	if duration < 1 {
+		duration = 1
+	}
+
+	// Velocity always comes from z
+	z := ce.Z * r.params.ParamFloatValue("sound.pressurescale")
+	velocity, err := r.velocityOf(z, r.params.ParamStringValue("sound.velocitycurve", "linear"))
+	if err != nil {
+		log.Printf("Reactor.playDrumPad: err=%s\n", err)
+		velocity, _ = r.velocityOf(z, "linear")
+	}
+
+	if DebugUtil.MIDI {
+		log.Printf("Reactor.playDrumPad: pad=%s pitch=%d velocity=%d\n", pad.Name, pad.Pitch, velocity)
+	}
+	p := NewPhrase()
+	p.InsertNote(NewNote(uint8(pad.Pitch), velocity, duration, synth))
+
+	// Starting a phrase with the same cid stops the previous one,
+	// which cuts off the other pads in the choke group
+	cid := ""
+	if pad.Choke != "" {
+		cid = "choke." + pad.Choke
+	}
+	r.activePhrasesManager.StartOneShot(p, cid)
+}
+
+// describeDrumPads returns the layout of the drum pads, for the GUI
+func (r *Reactor) describeDrumPads() *GridDescription {
+	desc := &GridDescription{Region: r.padName, Layout: "drumpads"}
+	kit := r.getDrumKit()
+	if kit == nil {
+		return desc
+	}
+	desc.Cols = kit.Cols
+	desc.Rows = kit.Rows
+	cellw := 1.0 / float32(kit.Cols)
+	cellh := 1.0 / float32(kit.Rows)
+	for _, pad := range kit.Pads {
+		desc.Cells = append(desc.Cells, GridCell{
+			Col: pad.Col, Row: pad.Row,
+			X0: float32(pad.Col) * cellw, Y0: float32(pad.Row) * cellh,
+			X1: float32(pad.Col+1) * cellw, Y1: float32(pad.Row+1) * cellh,
+			Pitch: pad.Pitch, Name: pad.Name, InScale: true,
+		})
+	}
+	return desc
+}
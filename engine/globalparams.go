@@ -0,0 +1,388 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ParamLink makes regions share the parameters that start with Prefix.
+// Setting one of them in any of the regions sets it in all of them.
+type ParamLink struct {
+	Regions string `json:"regions"` // e.g. "AB"
+	Prefix  string `json:"prefix"`  // e.g. "sound."
+}
+
+// paramLinks are the ParamLinks of the Router
+type paramLinks struct {
+	mutex sync.Mutex
+	links []*ParamLink
+}
+
+// exactParamValue formats a parameter value without
+// the rounding of floats that's done in preset files
+func exactParamValue(val ParamValue) string {
+	if f, ok := val.(paramValFloat); ok {
+		return fmt.Sprintf("%f", f.value)
+	}
+	return formatParamValue(val)
+}
+
+// linkedRegions returns the regions that are linked to region for a parameter
+func (pl *paramLinks) linkedRegions(region string, name string) []string {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	var regions []string
+	for _, link := range pl.links {
+		if !strings.Contains(link.Regions, region) || !strings.HasPrefix(name, link.Prefix) {
+			continue
+		}
+		for _, c := range link.Regions {
+			rname := string(c)
+			if rname != region {
+				regions = append(regions, rname)
+			}
+		}
+	}
+	return regions
+}
+
+// propagateLinkedParams sets the parameters that have just been set
+// in a region in all the regions linked to it
+func (r *Router) propagateLinkedParams(reactor *Reactor, values map[string]string) {
+	linkedValues := make(map[string]map[string]string)
+	for name, value := range values {
+		for _, rname := range r.links.linkedRegions(reactor.padName, name) {
+			if linkedValues[rname] == nil {
+				linkedValues[rname] = make(map[string]string)
+			}
+			linkedValues[rname][name] = value
+		}
+	}
+	for rname, lvalues := range linkedValues {
+		linked, ok := r.reactors[rname]
+		if !ok {
+			continue
+		}
+		for name := range lvalues {
+			linked.cancelRamp(name)
+		}
+		// The linked regions don't propagate them again
+		_, errs := linked.setParamsAndLinks(lvalues, false)
+		for name, err := range errs {
+			log.Printf("Router.propagateLinkedParams: region=%s param=%s err=%s\n", rname, name, err)
+		}
+	}
+}
+
+// paramSetResult is the result of the set_param and set_params APIs.
+// The parameter name is the key of both maps.
+type paramSetResult struct {
+	Adjusted map[string]string   `json:"adjusted,omitempty"` // values that weren't valid but were set, see paramvalidation
+	Skipped  map[string][]string `json:"skipped,omitempty"`  // regions that kept their overrides (global APIs only)
+}
+
+// setGlobalParam sets a global parameter, which changes it in all the
+// regions that haven't overridden it.  If clearOverrides is true, the
+// regions that have overridden it are changed too, otherwise the
+// names of those regions are returned.  warning is set if the value
+// was adjusted (see paramvalidation).
+func (r *Router) setGlobalParam(name string, value string, clearOverrides bool) (warning string, skipped []string, err error) {
+	olds := make(map[*Reactor]ParamValue)
+	var overriding []*Reactor
+	for _, reactor := range r.reactors {
+		if reactor.params.IsOverridden(name) {
+			overriding = append(overriding, reactor)
+		} else {
+			olds[reactor] = reactor.params.paramValue(name)
+		}
+	}
+	warning, err = r.globalParams.realSetParamValueWithString(name, value, nil, true)
+	if err != nil {
+		return "", nil, err
+	}
+	for reactor, old := range olds {
+		r.globalParamChanged(reactor, name, old)
+	}
+	for _, reactor := range overriding {
+		if clearOverrides {
+			reactor.clearOverride(name)
+		} else {
+			skipped = append(skipped, reactor.padName)
+		}
+	}
+	sort.Strings(skipped)
+	return warning, skipped, nil
+}
+
+// clearGlobalParam removes a global parameter, so the regions
+// that haven't overridden it go back to their initial value
+func (r *Router) clearGlobalParam(name string) {
+	olds := make(map[*Reactor]ParamValue)
+	for _, reactor := range r.reactors {
+		if !reactor.params.IsOverridden(name) {
+			olds[reactor] = reactor.params.paramValue(name)
+		}
+	}
+	r.globalParams.DeleteParamValue(name)
+	for reactor, old := range olds {
+		r.globalParamChanged(reactor, name, old)
+	}
+}
+
+// globalParamChanged does what's needed in a region when
+// the global value of a parameter that it uses changes
+func (r *Router) globalParamChanged(reactor *Reactor, name string, old ParamValue) {
+	val := reactor.params.paramValue(name)
+	if val == nil {
+		return
+	}
+	reactor.params.notifyObservers(name, old, val)
+	reactor.cancelRamp(name)
+	reactor.sendParam(name, exactParamValue(val))
+	reactor.paramUpdated(name)
+}
+
+// copyParams copies the parameters that start with prefix from one
+// region to another.  The parameters that come from the global values
+// in the first region will also come from them in the second one.
+func (r *Router) copyParams(from *Reactor, to *Reactor, prefix string) error {
+	values := make(map[string]string)
+	for _, name := range ParamNames(prefix) {
+		if from.params.IsOverridden(name) {
+			values[name] = exactParamValue(from.params.paramValue(name))
+		} else if to.params.IsOverridden(name) {
+			to.clearOverride(name)
+		}
+	}
+	_, errs := to.setParamValues(values)
+	if len(errs) > 0 {
+		var s []string
+		for name, err := range errs {
+			s = append(s, fmt.Sprintf("%s: %s", name, err))
+		}
+		sort.Strings(s)
+		return fmt.Errorf("Router.copyParams: %s", strings.Join(s, "; "))
+	}
+	return nil
+}
+
+// clearOverride makes a parameter of the region come from the global values again
+func (r *Reactor) clearOverride(name string) {
+	r.cancelRamp(name)
+	oldval, newval := r.params.ClearOverride(name)
+	if newval != nil && formatParamValue(oldval) != formatParamValue(newval) {
+		r.sendParam(name, exactParamValue(newval))
+		r.paramUpdated(name)
+	}
+}
+
+// clearOverrides is the clear_override API, with either a param arg
+// or a prefix arg (e.g. "sound.", or "" for all of them)
+func (r *Reactor) clearOverrides(api string, args map[string]string) error {
+	if name, ok := args["param"]; ok {
+		if !r.params.IsOverridden(name) {
+			return fmt.Errorf("api=%s parameter %s isn't overridden in region %s", api, name, r.padName)
+		}
+		r.clearOverride(name)
+		return nil
+	}
+	prefix, ok := args["prefix"]
+	if !ok {
+		return fmt.Errorf("api=%s needs a param or prefix arg", api)
+	}
+	for _, name := range r.params.Overrides() {
+		if strings.HasPrefix(name, prefix) {
+			r.clearOverride(name)
+		}
+	}
+	return nil
+}
+
+// optionalBoolArg returns the value of a bool arg, or dflt if it isn't given
+func optionalBoolArg(nm string, api string, args map[string]string, dflt bool) (bool, error) {
+	if _, ok := args[nm]; !ok {
+		return dflt, nil
+	}
+	return NeedBoolArg(nm, api, args)
+}
+
+// regionsArg returns the regions arg (e.g. "AB") of the link APIs
+func (r *Router) regionsArg(api string, args map[string]string) (string, error) {
+	regions, err := NeedStringArg("regions", api, args)
+	if err != nil {
+		return "", err
+	}
+	if len(regions) < 2 {
+		return "", fmt.Errorf("api=%s needs at least two regions", api)
+	}
+	for _, c := range regions {
+		if _, ok := r.reactors[string(c)]; !ok {
+			return "", fmt.Errorf("api=%s there is no region named %s", api, string(c))
+		}
+	}
+	return regions, nil
+}
+
+// globalParamsAPI handles the global APIs for parameters
+func (r *Router) globalParamsAPI(apisuffix string, api string, args map[string]string) (result interface{}, err error) {
+	switch apisuffix {
+
+	case "set_param":
+		var name, value string
+		var clearOverrides bool
+		name, err = NeedStringArg("param", api, args)
+		if err == nil {
+			value, err = NeedStringArg("value", api, args)
+		}
+		if err == nil {
+			clearOverrides, err = optionalBoolArg("clear_overrides", api, args, false)
+		}
+		if err == nil {
+			var warning string
+			var skipped []string
+			warning, skipped, err = r.setGlobalParam(name, value, clearOverrides)
+			res := paramSetResult{}
+			if warning != "" {
+				res.Adjusted = map[string]string{name: warning}
+			}
+			if len(skipped) > 0 {
+				res.Skipped = map[string][]string{name: skipped}
+			}
+			result = res
+		}
+
+	case "set_params":
+		clearOverrides, e := optionalBoolArg("clear_overrides", api, args, false)
+		if e != nil {
+			return nil, e
+		}
+		res := paramSetResult{
+			Adjusted: make(map[string]string),
+			Skipped:  make(map[string][]string),
+		}
+		var errs []string
+		for name, value := range args {
+			if name == "clear_overrides" {
+				continue
+			}
+			warning, skipped, e := r.setGlobalParam(name, value, clearOverrides)
+			if e != nil {
+				errs = append(errs, e.Error())
+			}
+			if warning != "" {
+				res.Adjusted[name] = warning
+			}
+			if len(skipped) > 0 {
+				res.Skipped[name] = skipped
+			}
+		}
+		if len(errs) > 0 {
+			sort.Strings(errs)
+			err = fmt.Errorf("Router.globalParamsAPI: %s", strings.Join(errs, "; "))
+		}
+		result = res
+
+	case "get_params":
+		prefix := OptionalStringArg("prefix", args, "")
+		values := make(map[string]string)
+		for _, name := range r.globalParams.Overrides() {
+			if strings.HasPrefix(name, prefix) {
+				values[name] = formatParamValue(r.globalParams.paramValue(name))
+			}
+		}
+		result = values
+
+	case "clear_param":
+		if name, ok := args["param"]; ok {
+			r.clearGlobalParam(name)
+			break
+		}
+		prefix, ok := args["prefix"]
+		if !ok {
+			return nil, fmt.Errorf("api=%s needs a param or prefix arg", api)
+		}
+		for _, name := range r.globalParams.Overrides() {
+			if strings.HasPrefix(name, prefix) {
+				r.clearGlobalParam(name)
+			}
+		}
+
+	case "link_params":
+		var regions, prefix string
+		regions, err = r.regionsArg(api, args)
+		if err == nil {
+			prefix, err = NeedStringArg("prefix", api, args)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.links.mutex.Lock()
+		r.links.links = append(r.links.links, &ParamLink{Regions: regions, Prefix: prefix})
+		r.links.mutex.Unlock()
+		// The other regions start with the values of the first one
+		from := r.reactors[regions[0:1]]
+		for _, c := range regions[1:] {
+			e := r.copyParams(from, r.reactors[string(c)], prefix)
+			if e != nil {
+				err = e
+			}
+		}
+
+	case "unlink_params":
+		var regions, prefix string
+		regions, err = r.regionsArg(api, args)
+		if err == nil {
+			prefix, err = NeedStringArg("prefix", api, args)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.links.mutex.Lock()
+		links := make([]*ParamLink, 0, len(r.links.links))
+		for _, link := range r.links.links {
+			if link.Regions != regions || link.Prefix != prefix {
+				links = append(links, link)
+			}
+		}
+		if len(links) == len(r.links.links) {
+			err = fmt.Errorf("api=%s there is no link of %s for %s", api, prefix, regions)
+		}
+		r.links.links = links
+		r.links.mutex.Unlock()
+
+	case "list_links":
+		r.links.mutex.Lock()
+		links := make([]ParamLink, 0, len(r.links.links))
+		for _, link := range r.links.links {
+			links = append(links, *link)
+		}
+		r.links.mutex.Unlock()
+		result = links
+
+	case "copy_params":
+		var fromName, toName string
+		fromName, err = NeedStringArg("from", api, args)
+		if err == nil {
+			toName, err = NeedStringArg("to", api, args)
+		}
+		if err != nil {
+			return nil, err
+		}
+		from, ok := r.reactors[fromName]
+		if !ok {
+			return nil, fmt.Errorf("api=%s there is no region named %s", api, fromName)
+		}
+		to, ok := r.reactors[toName]
+		if !ok {
+			return nil, fmt.Errorf("api=%s there is no region named %s", api, toName)
+		}
+		err = r.copyParams(from, to, OptionalStringArg("prefix", args, ""))
+
+	default:
+		return nil, fmt.Errorf("Router.globalParamsAPI: unknown api=%s", api)
+	}
+	return result, err
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxHTTPBody is the largest JSON body accepted by the HTTP API server
+const maxHTTPBody = 1 << 20
+
+// StartHTTPServer serves the APIs over HTTP, and never returns.
+// An API is executed with POST /api/{api} (e.g. /api/region.set_param),
+// with the args as a JSON object in the body, and Content-Type application/json.
+// An optional nuid query parameter identifies the caller (for APIs that use
+// the caller's region).  The response is the same JSON result or error
+// as NATS API requests get.  Web pages can only use the APIs if they come
+// from the origin in the httporigin setting (e.g. "http://localhost:8080").
+func StartHTTPServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", handleHTTPAPI)
+	log.Printf("StartHTTPServer: listening on %s\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	log.Printf("StartHTTPServer: addr=%s err=%s\n", addr, err)
+}
+
+func httpResponse(w http.ResponseWriter, status int, response string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(response))
+	if err != nil {
+		log.Printf("httpResponse: err=%s\n", err)
+	}
+}
+
+func handleHTTPAPI(w http.ResponseWriter, req *http.Request) {
+
+	// Requests from web pages (which have an Origin) are only
+	// allowed from the origin in the httporigin setting
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if origin != ConfigValue("httporigin") {
+			httpResponse(w, http.StatusForbidden, ErrorResponse(fmt.Errorf("origin %s not allowed", origin)))
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Vary", "Origin")
+	}
+
+	switch req.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		httpResponse(w, http.StatusMethodNotAllowed, ErrorResponse(fmt.Errorf("method %s not allowed, use POST", req.Method)))
+		return
+	}
+
+	// Only JSON bodies are accepted, so that other sites can't use
+	// the APIs with the simple (e.g. text/plain) requests browsers send freely
+	mediatype, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediatype != "application/json" {
+		httpResponse(w, http.StatusUnsupportedMediaType, ErrorResponse(fmt.Errorf("Content-Type needs to be application/json")))
+		return
+	}
+
+	api := strings.TrimPrefix(req.URL.Path, "/api/")
+	if api == "" {
+		httpResponse(w, http.StatusNotFound, ErrorResponse(fmt.Errorf("missing api, use /api/{api}")))
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxHTTPBody))
+	if err != nil {
+		httpResponse(w, http.StatusBadRequest, ErrorResponse(fmt.Errorf("unable to read body, err=%s", err)))
+		return
+	}
+	rawargs := strings.TrimSpace(string(bytes))
+	if rawargs == "" {
+		rawargs = "{}"
+	}
+	if _, err := StringMap(rawargs); err != nil {
+		httpResponse(w, http.StatusBadRequest, ErrorResponse(fmt.Errorf("body needs to be a JSON object, err=%s", err)))
+		return
+	}
+
+	nuid := req.URL.Query().Get("nuid")
+	if nuid == "" {
+		nuid = MyNUID()
+	}
+	if DebugUtil.API {
+		log.Printf("handleHTTPAPI: api=%s nuid=%s args=%s\n", api, nuid, rawargs)
+	}
+
+	r := TheRouter()
+	r.eventMutex.Lock()
+	result, err := r.ExecuteAPI(api, nuid, rawargs)
+	r.eventMutex.Unlock()
+
+	if err != nil {
+		httpResponse(w, http.StatusBadRequest, ErrorResponse(err))
+		return
+	}
+	httpResponse(w, http.StatusOK, ResultResponse(result))
+}
@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// GridCell is one cell of a region's layout, as described for the GUI.
+// The coordinates are in the same 0.0-1.0 space as gestures.
+type GridCell struct {
+	Col     int     `json:"col"`
+	Row     int     `json:"row"`
+	X0      float32 `json:"x0"`
+	Y0      float32 `json:"y0"`
+	X1      float32 `json:"x1"`
+	Y1      float32 `json:"y1"`
+	Pitch   int     `json:"pitch"`
+	Name    string  `json:"name"`
+	InScale bool    `json:"inscale"`
+}
+
+// GridDescription describes the layout of pitches in a region
+type GridDescription struct {
+	Region string     `json:"region"`
+	Layout string     `json:"layout"`
+	Cols   int        `json:"cols"`
+	Rows   int        `json:"rows"`
+	Hex    bool       `json:"hex"` // if true, odd rows are offset by half a cell
+	Cells  []GridCell `json:"cells"`
+}
+
+// gridIsHex returns true for the isomorphic layouts that are hexagonal
+func gridIsHex(layout string) bool {
+	return layout == "wickihayden" || layout == "harmonictable"
+}
+
+// gridOffset returns the interval (in semitones, or scale steps)
+// of a cell above the cell at the lower left.
+// The hex layouts use "odd-r" offset coordinates, converted to axial
+// coordinates so that each direction always has the same interval.
+func gridOffset(layout string, col, row, cols int) int {
+	q := col - (row-(row&1))/2
+	switch layout {
+	case "wickihayden":
+		// right is a whole tone, up-right a fifth, up-left a fourth
+		return 2*q + 7*row
+	case "harmonictable":
+		// up-right is a major third, up-left a minor third
+		return q + 4*row
+	case "fourths":
+		// like a bass or guitar in standard tuning
+		return col + 5*row
+	default: // "grid"
+		return col + cols*row
+	}
+}
+
+// gridSize returns the number of columns and rows of the grid layout
+func (r *Reactor) gridSize() (cols, rows int) {
+	cols = r.params.ParamIntValue("sound.gridcols")
+	rows = r.params.ParamIntValue("sound.gridrows")
+	if cols < 1 {
+		cols = 1
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	return cols, rows
+}
+
+// gridCellOf returns the cell of the grid layout at x,y
+func (r *Reactor) gridCellOf(x, y float32) (col, row int) {
+	layout := r.params.ParamStringValue("sound.gridlayout", "grid")
+	cols, rows := r.gridSize()
+	row = clampInt(int(y*float32(rows)), 0, rows-1)
+	if gridIsHex(layout) && row&1 == 1 {
+		x -= 0.5 / float32(cols)
+	}
+	col = clampInt(int(x*float32(cols)), 0, cols-1)
+	return col, row
+}
+
+// gridCellPitch returns the pitch of a cell, and whether it's in the scale
+func (r *Reactor) gridCellPitch(col, row int, scale *Scale) (uint8, bool) {
+	layout := r.params.ParamStringValue("sound.gridlayout", "grid")
+	cols, _ := r.gridSize()
+	base := clampInt(r.params.ParamIntValue("sound.pitchmin"), 0, 127)
+	offset := gridOffset(layout, col, row, cols)
+
+	filter := r.params.ParamStringValue("sound.gridscale", "snap")
+	switch filter {
+	case "steps":
+		// The intervals of the layout are scale steps rather than semitones
+		p, ok := scale.StepsAbove(scale.ClosestTo(uint8(base)), offset)
+		return p, ok
+	case "none":
+		p := clampInt(base+offset, 0, 127)
+		return uint8(p), scale.hasNote[p]
+	case "snap":
+		p := uint8(clampInt(base+offset, 0, 127))
+		return scale.ClosestTo(p), true
+	default:
+		log.Printf("Unrecognized gridscale value: %s, assuming snap\n", filter)
+		p := uint8(clampInt(base+offset, 0, 127))
+		return scale.ClosestTo(p), true
+	}
+}
+
+// gridPitch returns the pitch at x,y when misc.logic_sound is "midigrid"
+func (r *Reactor) gridPitch(x, y float32) uint8 {
+	col, row := r.gridCellOf(x, y)
+	p, _ := r.gridCellPitch(col, row, r.getScale())
+	return p
+}
+
+// describeLayout returns the layout of pitches in the region
+func (r *Reactor) describeLayout() *GridDescription {
+	scale := r.getScale()
+	logic := r.params.ParamStringValue("misc.logic_sound", "default")
+	if logic == "drumpads" {
+		return r.describeDrumPads()
+	}
+	if logic != "midigrid" {
+		// The default logic maps x onto pitchmin-pitchmax
+		pitchmin := r.params.ParamIntValue("sound.pitchmin")
+		pitchmax := r.params.ParamIntValue("sound.pitchmax")
+		cols := clampInt(pitchmax-pitchmin+1, 1, 128)
+		desc := &GridDescription{Region: r.padName, Layout: logic, Cols: cols, Rows: 1}
+		for col := 0; col < cols; col++ {
+			p := scale.ClosestTo(uint8(clampInt(pitchmin+col, 0, 127)))
+			desc.Cells = append(desc.Cells, GridCell{
+				Col: col, Row: 0,
+				X0: float32(col) / float32(cols), Y0: 0.0,
+				X1: float32(col+1) / float32(cols), Y1: 1.0,
+				Pitch: int(p), Name: pitchName(p), InScale: true,
+			})
+		}
+		return desc
+	}
+
+	layout := r.params.ParamStringValue("sound.gridlayout", "grid")
+	cols, rows := r.gridSize()
+	hex := gridIsHex(layout)
+	desc := &GridDescription{Region: r.padName, Layout: layout, Cols: cols, Rows: rows, Hex: hex}
+	cellw := 1.0 / float32(cols)
+	cellh := 1.0 / float32(rows)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			x0 := float32(col) * cellw
+			if hex && row&1 == 1 {
+				x0 += cellw / 2
+			}
+			p, inscale := r.gridCellPitch(col, row, scale)
+			desc.Cells = append(desc.Cells, GridCell{
+				Col: col, Row: row,
+				X0: x0, Y0: float32(row) * cellh,
+				X1: x0 + cellw, Y1: float32(row+1) * cellh,
+				Pitch: int(p), Name: pitchName(p), InScale: inscale,
+			})
+		}
+	}
+	return desc
+}
+
+// layoutJSON is the result of the layout API
+func (r *Reactor) layoutJSON() (string, error) {
+	bytes, err := json.Marshal(r.describeLayout())
+	if err != nil {
+		return "", fmt.Errorf("Reactor.layoutJSON: err=%s", err)
+	}
+	return string(bytes), nil
+}
+
+// RegionLayout returns the layout of pitches in a region, e.g. for the GUI
+func (r *Router) RegionLayout(region string) (*GridDescription, error) {
+	reactor, ok := r.reactors[region]
+	if !ok {
+		return nil, fmt.Errorf("RegionLayout: no region named %s", region)
+	}
+	return reactor.describeLayout(), nil
+}
+
+// pitchName returns e.g. "C#4" for 61
+func pitchName(p uint8) string {
+	return fmt.Sprintf("%s%d", KeyNames[p%12], int(p)/12-1)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
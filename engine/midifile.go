@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"sort"
 )
 
 // These are the values of MIDI status bytes
@@ -66,14 +67,44 @@ func NewMIDIFile(path string) (*MIDIFile, error) {
 // Phrase returns a single Phrase containing all tracks in the MIDIFile
 func (m *MIDIFile) Phrase() *Phrase {
 	if m.phrase == nil {
-		m.phrase = NewPhrase()
+		p := NewPhrase()
 		for n := 0; n < m.ntracks; n++ {
-			m.phrase = m.phrase.Merge(m.tracks[n])
+			p = p.Merge(m.tracks[n])
 		}
+		m.phrase = withAllSynths(p)
 	}
 	return m.phrase
 }
 
+// withAllSynths returns a copy of a Phrase in which the messages
+// that have no synth (SysEx and other messages without a channel)
+// are sent to each of the synths used in the Phrase
+func withAllSynths(p *Phrase) *Phrase {
+	var synths []string
+	seen := make(map[string]bool)
+	for n := p.firstnote; n != nil; n = n.next {
+		if n.Sound != "" && !seen[n.Sound] {
+			seen[n.Sound] = true
+			synths = append(synths, n.Sound)
+		}
+	}
+	sort.Strings(synths)
+
+	newp := NewPhrase()
+	for n := p.firstnote; n != nil; n = n.next {
+		if n.Sound != "" {
+			newp.CopyAndAppend(n)
+			continue
+		}
+		for _, synth := range synths {
+			newn := newp.CopyAndAppend(n)
+			newn.Sound = synth
+		}
+	}
+	newp.ResetLengthNoLock()
+	return newp
+}
+
 // Parse reads the contents of a MIDIFile and creates Phrases for each track
 func (m *MIDIFile) Parse() error {
 	if m.parsed {
@@ -211,6 +242,9 @@ func (m *MIDIFile) msgadd(c byte) {
 func (m *MIDIFile) msgbytes() []byte {
 	return m.bytes
 }
+func (m *MIDIFile) msgcomplete() bool {
+	return len(m.bytes) > 0 && m.bytes[len(m.bytes)-1] == 0xf7
+}
 func (m *MIDIFile) metaevent(metatype byte) {
 }
 func (m *MIDIFile) noteon(synth string, pitch, velocity byte) {
@@ -505,7 +539,7 @@ func (m *MIDIFile) readTrack() error {
 				m.msgadd(c)
 			}
 
-			if c == 0xf7 || m.dosysexcontinue {
+			if m.msgcomplete() || m.dosysexcontinue {
 				m.sysex("", m.msgbytes())
 			} else {
 				sysexcontinue = true
@@ -534,7 +568,7 @@ func (m *MIDIFile) readTrack() error {
 
 			if sysexcontinue == false {
 				m.arbitrary("", m.msgbytes())
-			} else if c == 0xf7 {
+			} else if m.msgcomplete() {
 				m.sysex("", m.msgbytes())
 				sysexcontinue = false
 			}
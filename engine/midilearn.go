@@ -0,0 +1,312 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vizicist/portmidi"
+)
+
+// MIDIBinding maps an incoming MIDI controller or note
+// to a parameter (or an API) of a region.
+type MIDIBinding struct {
+	Region  string  `json:"region"`
+	Param   string  `json:"param,omitempty"` // e.g. "visual.hueinitial" or "effect.1-blur:quality"
+	API     string  `json:"api,omitempty"`   // e.g. "loop_clear", used if Param is ""
+	Type    string  `json:"type"`            // "controller" or "note"
+	Channel int     `json:"channel"`         // 1-16
+	Data1   int     `json:"data1"`           // controller or note number
+	Min     float32 `json:"min"`
+	Max     float32 `json:"max"`
+
+	lastValue int // to detect the rising edge when a controller triggers an API
+}
+
+type midiBindingsFile struct {
+	Bindings []*MIDIBinding `json:"bindings"`
+}
+
+// MIDILearner keeps the MIDI bindings, and the binding (if any)
+// that is currently armed and waiting for some MIDI input.
+type MIDILearner struct {
+	mutex    sync.Mutex
+	armed    *MIDIBinding
+	bindings []*MIDIBinding
+}
+
+var onceMIDILearner sync.Once
+var oneMIDILearner *MIDILearner
+
+// TheMIDILearner returns the one-and-only MIDILearner,
+// loading the saved bindings the first time it's called.
+func TheMIDILearner() *MIDILearner {
+	onceMIDILearner.Do(func() {
+		oneMIDILearner = &MIDILearner{}
+		err := oneMIDILearner.load()
+		if err != nil {
+			log.Printf("MIDILearner.load: err=%s\n", err)
+		}
+	})
+	return oneMIDILearner
+}
+
+func midiLearnFilePath() string {
+	return LocalConfigFilePath("midilearn.json")
+}
+
+func (l *MIDILearner) load() error {
+	path := midiLearnFilePath()
+	if path == "" || !fileExists(path) {
+		return nil // It's okay if file isn't present
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f midiBindingsFile
+	err = json.Unmarshal(bytes, &f)
+	if err != nil {
+		return fmt.Errorf("unable to Unmarshal %s, err=%s", path, err)
+	}
+	l.bindings = f.Bindings
+	return nil
+}
+
+// save assumes the mutex is held
+func (l *MIDILearner) save() error {
+	path := midiLearnFilePath()
+	if path == "" {
+		return fmt.Errorf("MIDILearner.save: no local config directory")
+	}
+	bytes, err := json.MarshalIndent(midiBindingsFile{Bindings: l.bindings}, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0644)
+}
+
+// Arm makes the next controller or note that arrives for
+// the binding's region get bound to the binding's target.
+func (l *MIDILearner) Arm(b *MIDIBinding) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.armed = b
+}
+
+// Cancel disarms any binding waiting for MIDI input
+func (l *MIDILearner) Cancel() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.armed = nil
+}
+
+// Unlearn removes all bindings of a region to a parameter or API
+func (l *MIDILearner) Unlearn(region string, target string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	newbindings := l.bindings[:0]
+	for _, b := range l.bindings {
+		if b.Region == region && (b.Param == target || b.API == target) {
+			continue
+		}
+		newbindings = append(newbindings, b)
+	}
+	l.bindings = newbindings
+	return l.save()
+}
+
+// Clear removes all bindings
+func (l *MIDILearner) Clear() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bindings = nil
+	l.armed = nil
+	return l.save()
+}
+
+// Bindings returns a copy of the current bindings
+func (l *MIDILearner) Bindings() []MIDIBinding {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bindings := make([]MIDIBinding, 0, len(l.bindings))
+	for _, b := range l.bindings {
+		bindings = append(bindings, *b)
+	}
+	return bindings
+}
+
+// HandleMIDIDeviceInput either binds the event to an armed binding,
+// or applies any bindings that match it.  It returns true if the
+// event was consumed, i.e. it shouldn't be passed through.
+func (l *MIDILearner) HandleMIDIDeviceInput(r *Reactor, e portmidi.Event) bool {
+
+	status := e.Status & 0xf0
+	channel := int(e.Status&0x0f) + 1
+	data1 := int(e.Data1)
+	data2 := int(e.Data2)
+
+	var btype string
+	switch status {
+	case 0xb0:
+		btype = "controller"
+	case 0x90, 0x80:
+		btype = "note"
+	default:
+		return false
+	}
+
+	l.mutex.Lock()
+
+	if l.armed != nil && l.armed.Region == r.padName {
+		// Note-offs don't get bound, they're just the end of the learning note
+		if status == 0x80 || (status == 0x90 && data2 == 0) {
+			l.mutex.Unlock()
+			return true
+		}
+		b := l.armed
+		l.armed = nil
+		b.Type = btype
+		b.Channel = channel
+		b.Data1 = data1
+		// A new binding replaces any existing binding of the same MIDI input
+		newbindings := l.bindings[:0]
+		for _, old := range l.bindings {
+			if old.Region == b.Region && old.Type == b.Type && old.Channel == b.Channel && old.Data1 == b.Data1 {
+				continue
+			}
+			newbindings = append(newbindings, old)
+		}
+		l.bindings = append(newbindings, b)
+		err := l.save()
+		l.mutex.Unlock()
+		if err != nil {
+			log.Printf("MIDILearner: unable to save bindings, err=%s\n", err)
+		}
+		log.Printf("MIDILearner: region=%s %s channel=%d data1=%d is bound to %s%s\n",
+			b.Region, b.Type, b.Channel, b.Data1, b.Param, b.API)
+		return true
+	}
+
+	var matched []*MIDIBinding
+	for _, b := range l.bindings {
+		if b.Region == r.padName && b.Type == btype && b.Channel == channel && b.Data1 == data1 {
+			matched = append(matched, b)
+		}
+	}
+	l.mutex.Unlock()
+
+	if len(matched) == 0 {
+		return false
+	}
+
+	// Scale the MIDI value to 0.0 through 1.0
+	value := 0
+	if status == 0xb0 || status == 0x90 {
+		value = data2
+	}
+	f := float32(value) / 127.0
+	if btype == "note" && value > 0 {
+		f = 1.0
+	}
+
+	for _, b := range matched {
+		if b.Param != "" {
+			v := b.Min + f*(b.Max-b.Min)
+			err := r.setParamFromMIDI(b.Param, v)
+			if err != nil {
+				log.Printf("MIDILearner: param=%s err=%s\n", b.Param, err)
+			}
+			continue
+		}
+		// APIs are triggered when a note goes down, or a controller crosses the middle
+		rising := value >= 64 && b.lastValue < 64
+		b.lastValue = value
+		if rising {
+			_, err := r.ExecuteAPI(b.API, map[string]string{}, "{}")
+			if err != nil {
+				log.Printf("MIDILearner: api=%s err=%s\n", b.API, err)
+			}
+		}
+	}
+	return true
+}
+
+// paramRange returns the default min and max values
+// that a MIDI binding should use for a parameter.
+func (r *Reactor) paramRange(name string) (min float32, max float32, err error) {
+	def, err := r.params.paramDefOf(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch d := def.typedParamDef.(type) {
+	case paramDefInt:
+		return float32(d.min), float32(d.max), nil
+	case paramDefFloat:
+		return d.min, d.max, nil
+	case paramDefBool:
+		return 0, 1, nil
+	case paramDefString:
+		if len(d.values) == 0 {
+			return 0, 0, fmt.Errorf("parameter %s has no enumerated values", name)
+		}
+		return 0, float32(len(d.values) - 1), nil
+	default:
+		return 0, 0, fmt.Errorf("no parameter named %s", name)
+	}
+}
+
+// setParamFromMIDI sets a parameter from a (scaled) MIDI value,
+// using the same path as the set_param API.
+func (r *Reactor) setParamFromMIDI(name string, f float32) error {
+	def, err := r.params.paramDefOf(name)
+	if err != nil {
+		return err
+	}
+	var value string
+	switch d := def.typedParamDef.(type) {
+	case paramDefInt:
+		value = strconv.Itoa(int(math.Round(float64(f))))
+	case paramDefFloat:
+		value = fmt.Sprintf("%f", f)
+	case paramDefBool:
+		value = strconv.FormatBool(f >= 0.5)
+	case paramDefString:
+		if len(d.values) == 0 {
+			return fmt.Errorf("parameter %s has no enumerated values", name)
+		}
+		i := int(math.Round(float64(f)))
+		if i < 0 {
+			i = 0
+		} else if i >= len(d.values) {
+			i = len(d.values) - 1
+		}
+		value = d.values[i]
+	default:
+		return fmt.Errorf("no parameter named %s", name)
+	}
+	dot := strings.Index(name, ".")
+	if dot < 0 {
+		return fmt.Errorf("parameter %s has no category", name)
+	}
+	apiprefix := name[0 : dot+1]
+	args := map[string]string{
+		"param": name[dot+1:],
+		"value": value,
+	}
+	rawargs := "{ \"param\": \"" + jsonEscape(name[dot+1:]) + "\", \"value\": \"" + jsonEscape(value) + "\" }"
+	_, err = r.ExecuteAPI(apiprefix+"set_param", args, rawargs)
+	return err
+}
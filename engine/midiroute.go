@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MIDIRoute sends the MIDI input from a port (and channel) to a region
+type MIDIRoute struct {
+	Port    string `json:"port"`    // "*" matches any port
+	Channel int    `json:"channel"` // 1-16, 0 matches any channel
+	Region  string `json:"region"`  // "A", "B", etc, "*" for all regions, or "none" to drop the input
+}
+
+func (rt MIDIRoute) matches(port string, channel int) bool {
+	if rt.Port != "*" && rt.Port != port {
+		return false
+	}
+	return rt.Channel == 0 || rt.Channel == channel
+}
+
+// parseMIDIRoutes parses the midiroutes value in settings.json,
+// which looks like "microKEY2 Air,*,A;nanoKONTROL2,1,C"
+// i.e. a semicolon-separated list of port,channel,region
+func parseMIDIRoutes(s string) ([]MIDIRoute, error) {
+	routes := make([]MIDIRoute, 0)
+	for _, rs := range strings.Split(s, ";") {
+		rs = strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+		words := strings.Split(rs, ",")
+		if len(words) != 3 {
+			return nil, fmt.Errorf("parseMIDIRoutes: expecting port,channel,region - got %s", rs)
+		}
+		rt, err := makeMIDIRoute(strings.TrimSpace(words[0]), strings.TrimSpace(words[1]), strings.TrimSpace(words[2]))
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+func makeMIDIRoute(port string, channel string, region string) (MIDIRoute, error) {
+	rt := MIDIRoute{Port: port, Region: region}
+	if port == "" {
+		return rt, fmt.Errorf("MIDI route has no port")
+	}
+	if channel != "*" && channel != "" {
+		ch, err := strconv.Atoi(channel)
+		if err != nil || ch < 1 || ch > 16 {
+			return rt, fmt.Errorf("MIDI route has bad channel value (%s)", channel)
+		}
+		rt.Channel = ch
+	}
+	if region == "" {
+		rt.Region = "none"
+	}
+	return rt, nil
+}
+
+// reactorsForMIDIInput returns the reactors that should get
+// a MIDI event from a port.  The first matching route wins,
+// and if no route matches, all reactors get it.
+func (r *Router) reactorsForMIDIInput(port string, status int64) []*Reactor {
+
+	r.midiRoutesMutex.RLock()
+	defer r.midiRoutesMutex.RUnlock()
+
+	channel := int(status&0x0f) + 1
+	region := "*"
+	for _, rt := range r.midiRoutes {
+		if rt.matches(port, channel) {
+			region = rt.Region
+			break
+		}
+	}
+
+	reactors := make([]*Reactor, 0, len(r.reactors))
+	switch region {
+	case "none":
+	case "*":
+		for _, reactor := range r.reactors {
+			reactors = append(reactors, reactor)
+		}
+	default:
+		reactor, ok := r.reactors[region]
+		if ok {
+			reactors = append(reactors, reactor)
+		}
+	}
+	return reactors
+}
+
+func (r *Router) addMIDIRoute(api string, args map[string]string) error {
+	port, err := NeedStringArg("port", api, args)
+	if err != nil {
+		return err
+	}
+	region, err := NeedStringArg("region", api, args)
+	if err != nil {
+		return err
+	}
+	channel := OptionalStringArg("channel", args, "*")
+	rt, err := makeMIDIRoute(port, channel, region)
+	if err != nil {
+		return err
+	}
+	if rt.Region != "*" && rt.Region != "none" {
+		if _, ok := r.reactors[rt.Region]; !ok {
+			return fmt.Errorf("api=%s there is no region named %s", api, rt.Region)
+		}
+	}
+
+	r.midiRoutesMutex.Lock()
+	defer r.midiRoutesMutex.Unlock()
+
+	// A route for the same port and channel replaces the existing one
+	for i, old := range r.midiRoutes {
+		if old.Port == rt.Port && old.Channel == rt.Channel {
+			r.midiRoutes[i] = rt
+			return nil
+		}
+	}
+	r.midiRoutes = append(r.midiRoutes, rt)
+	return nil
+}
+
+func (r *Router) removeMIDIRoute(api string, args map[string]string) error {
+	port, err := NeedStringArg("port", api, args)
+	if err != nil {
+		return err
+	}
+	rt, err := makeMIDIRoute(port, OptionalStringArg("channel", args, "*"), "")
+	if err != nil {
+		return err
+	}
+
+	r.midiRoutesMutex.Lock()
+	defer r.midiRoutesMutex.Unlock()
+
+	newroutes := r.midiRoutes[:0]
+	for _, old := range r.midiRoutes {
+		if old.Port != rt.Port || old.Channel != rt.Channel {
+			newroutes = append(newroutes, old)
+		}
+	}
+	r.midiRoutes = newroutes
+	return nil
+}
+
+func (r *Router) clearMIDIRoutes() {
+	r.midiRoutesMutex.Lock()
+	defer r.midiRoutesMutex.Unlock()
+	r.midiRoutes = make([]MIDIRoute, 0)
+}
+
+func (r *Router) listMIDIRoutes() []MIDIRoute {
+	r.midiRoutesMutex.RLock()
+	defer r.midiRoutesMutex.RUnlock()
+	// NOTE: the builtin copy is hidden by the one in copy.go
+	return append([]MIDIRoute{}, r.midiRoutes...)
+}
@@ -0,0 +1,580 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Modulator is an LFO or envelope that can be routed to parameters
+type Modulator struct {
+	Name    string  `json:"name"`
+	Type    string  `json:"type"`    // "lfo" or "envelope"
+	Shape   string  `json:"shape"`   // lfo: "sine", "triangle", "square", or "random" (sample & hold)
+	Rate    float32 `json:"rate"`    // lfo: length of one cycle, in beats
+	Attack  float32 `json:"attack"`  // envelope: in beats
+	Decay   float32 `json:"decay"`   // envelope: in beats
+	Sustain float32 `json:"sustain"` // envelope: level, 0.0-1.0
+	Release float32 `json:"release"` // envelope: in beats
+	Region  string  `json:"region"`  // envelope: the region whose gestures trigger it, or "" for all
+
+	value        float32 // lfo: -1.0-1.0, envelope: 0.0-1.0
+	held         int     // envelope: number of gestures down
+	triggeredAt  Clicks
+	releasedAt   Clicks
+	releaseLevel float32
+	released     bool
+	idle         bool // envelope: fully released (or never triggered)
+	cycle        Clicks
+}
+
+// ModRoute sends a Modulator to a parameter of a region.
+// Depth is a fraction of the parameter's range.
+type ModRoute struct {
+	Modulator string  `json:"modulator"`
+	Region    string  `json:"region"`
+	Param     string  `json:"param"`
+	Depth     float32 `json:"depth"`
+}
+
+// ModulationPreset is what's saved in a presets/modulation file
+type ModulationPreset struct {
+	Modulators []*Modulator `json:"modulators"`
+	Routes     []*ModRoute  `json:"routes"`
+}
+
+// Modulation holds all the Modulators and their routes
+type Modulation struct {
+	mutex      sync.Mutex
+	modulators map[string]*Modulator
+	routes     []*ModRoute
+	lastKeys   map[string]bool   // region.param of the params modulated on the last click
+	lastSent   map[string]string // region.param is the key, value is the last one sent to Resolume/FreeFrame
+}
+
+// NewModulation makes a new Modulation
+func NewModulation() *Modulation {
+	return &Modulation{
+		modulators: make(map[string]*Modulator),
+		lastKeys:   make(map[string]bool),
+		lastSent:   make(map[string]string),
+	}
+}
+
+func beatsToClicks(beats float32) Clicks {
+	c := Clicks(beats*float32(oneBeat) + 0.5)
+	if c < 1 {
+		c = 1
+	}
+	return c
+}
+
+// advance computes the value of the modulator at clk
+func (m *Modulator) advance(clk Clicks) {
+	switch m.Type {
+	case "lfo":
+		length := beatsToClicks(m.Rate)
+		phase := float64(clk%length) / float64(length)
+		switch m.Shape {
+		case "triangle":
+			m.value = float32(4.0*math.Abs(phase-0.5) - 1.0)
+		case "square":
+			if phase < 0.5 {
+				m.value = 1.0
+			} else {
+				m.value = -1.0
+			}
+		case "random":
+			// A new random value at the start of every cycle
+			if c := clk / length; c != m.cycle {
+				m.cycle = c
+				m.value = rand.Float32()*2.0 - 1.0
+			}
+		default: // "sine"
+			m.value = float32(math.Sin(2.0 * math.Pi * phase))
+		}
+
+	case "envelope":
+		if m.idle {
+			m.value = 0.0
+			return
+		}
+		if m.released {
+			dt := float32(clk-m.releasedAt) / float32(beatsToClicks(m.Release))
+			if dt >= 1.0 {
+				m.value = 0.0
+				m.idle = true
+			} else {
+				m.value = m.releaseLevel * (1.0 - dt)
+			}
+			return
+		}
+		attack := beatsToClicks(m.Attack)
+		decay := beatsToClicks(m.Decay)
+		dt := clk - m.triggeredAt
+		switch {
+		case dt < 0:
+			m.value = 0.0
+		case dt < attack:
+			m.value = float32(dt) / float32(attack)
+		case dt < attack+decay:
+			m.value = 1.0 - (1.0-m.Sustain)*float32(dt-attack)/float32(decay)
+		default:
+			m.value = m.Sustain
+		}
+	}
+}
+
+// validate checks the definition of a Modulator
+func (m *Modulator) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("modulator has no name")
+	}
+	switch m.Type {
+	case "lfo":
+		switch m.Shape {
+		case "sine", "triangle", "square", "random":
+		default:
+			return fmt.Errorf("modulator %s has unknown shape %s", m.Name, m.Shape)
+		}
+		if m.Rate <= 0 {
+			return fmt.Errorf("modulator %s needs a rate > 0", m.Name)
+		}
+	case "envelope":
+		if m.Sustain < 0 || m.Sustain > 1 {
+			return fmt.Errorf("modulator %s needs a sustain of 0.0-1.0", m.Name)
+		}
+	default:
+		return fmt.Errorf("modulator %s has unknown type %s", m.Name, m.Type)
+	}
+	return nil
+}
+
+// gestureDown triggers the envelopes for a region
+func (mod *Modulation) gestureDown(region string) {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	for _, m := range mod.modulators {
+		if m.Type != "envelope" || (m.Region != "" && m.Region != region) {
+			continue
+		}
+		if m.held == 0 {
+			m.triggeredAt = currentClick
+			m.released = false
+			m.idle = false
+		}
+		m.held++
+	}
+}
+
+// gestureUp releases the envelopes for a region, once all its gestures are up
+func (mod *Modulation) gestureUp(region string) {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	for _, m := range mod.modulators {
+		if m.Type != "envelope" || (m.Region != "" && m.Region != region) || m.held == 0 {
+			continue
+		}
+		m.held--
+		if m.held == 0 {
+			m.released = true
+			m.releasedAt = currentClick
+			m.releaseLevel = m.value
+		}
+	}
+}
+
+// advance is called on every click, and sets the offsets
+// of all the modulated parameters in the regions
+func (mod *Modulation) advance(clk Clicks, reactors map[string]*Reactor) {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+
+	if len(mod.routes) == 0 && len(mod.lastKeys) == 0 {
+		return
+	}
+	for _, m := range mod.modulators {
+		m.advance(clk)
+	}
+
+	offsets := make(map[string]float32)
+	for _, route := range mod.routes {
+		m, ok := mod.modulators[route.Modulator]
+		if !ok {
+			continue
+		}
+		reactor, ok := reactors[route.Region]
+		if !ok {
+			continue
+		}
+		min, max, err := reactor.paramRange(route.Param)
+		if err != nil {
+			continue
+		}
+		offsets[route.Region+"."+route.Param] += route.Depth * m.value * (max - min)
+	}
+
+	// Parameters that are no longer modulated go back to their base value
+	for key := range mod.lastKeys {
+		if _, ok := offsets[key]; !ok {
+			offsets[key] = 0
+		}
+	}
+	mod.lastKeys = make(map[string]bool)
+	for key, offset := range offsets {
+		region := key[:strings.Index(key, ".")]
+		param := key[len(region)+1:]
+		reactor := reactors[region]
+		reactor.params.SetParamOffset(param, offset)
+		mod.sendModulated(reactor, key, param)
+		if param == "misc.morph" {
+			reactor.applyMorph()
+		}
+		if offset != 0 {
+			mod.lastKeys[key] = true
+		} else {
+			delete(mod.lastSent, key)
+		}
+	}
+}
+
+// sendModulated forwards the modulated value of a visual.* or effect.*
+// parameter, when it has changed
+func (mod *Modulation) sendModulated(reactor *Reactor, key string, param string) {
+	if !strings.HasPrefix(param, "visual.") && !strings.HasPrefix(param, "effect.") {
+		return
+	}
+	base, isInt, err := reactor.params.paramNumericValue(param)
+	if err != nil {
+		return
+	}
+	min, max, err := reactor.paramRange(param)
+	if err != nil {
+		return
+	}
+	v := base + reactor.params.paramOffset(param)
+	if v < min {
+		v = min
+	} else if v > max {
+		v = max
+	}
+	var value string
+	if isInt {
+		value = strconv.Itoa(int(math.Round(float64(v))))
+	} else {
+		value = fmt.Sprintf("%f", v)
+	}
+	if mod.lastSent[key] == value {
+		return
+	}
+	mod.lastSent[key] = value
+	if strings.HasPrefix(param, "effect.") {
+		reactor.sendEffectParam(strings.TrimPrefix(param, "effect."), value)
+	} else {
+		reactor.sendVisualParam(strings.TrimPrefix(param, "visual."), value)
+	}
+}
+
+// setModulator adds or replaces a Modulator
+func (mod *Modulation) setModulator(m *Modulator) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	m.idle = true
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	mod.modulators[m.Name] = m
+	return nil
+}
+
+// deleteModulator removes a Modulator and its routes
+func (mod *Modulation) deleteModulator(name string) error {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	if _, ok := mod.modulators[name]; !ok {
+		return fmt.Errorf("no modulator named %s", name)
+	}
+	delete(mod.modulators, name)
+	routes := make([]*ModRoute, 0, len(mod.routes))
+	for _, route := range mod.routes {
+		if route.Modulator != name {
+			routes = append(routes, route)
+		}
+	}
+	mod.routes = routes
+	return nil
+}
+
+// setRoute adds a route, or changes the depth of an existing one
+func (mod *Modulation) setRoute(route *ModRoute) {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	for _, rt := range mod.routes {
+		if rt.Modulator == route.Modulator && rt.Region == route.Region && rt.Param == route.Param {
+			rt.Depth = route.Depth
+			return
+		}
+	}
+	mod.routes = append(mod.routes, route)
+}
+
+// deleteRoute removes a route
+func (mod *Modulation) deleteRoute(modulator, region, param string) {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	routes := make([]*ModRoute, 0, len(mod.routes))
+	for _, rt := range mod.routes {
+		if rt.Modulator != modulator || rt.Region != region || rt.Param != param {
+			routes = append(routes, rt)
+		}
+	}
+	mod.routes = routes
+}
+
+// Preset returns the current Modulators and routes
+func (mod *Modulation) Preset() *ModulationPreset {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	p := &ModulationPreset{
+		Modulators: make([]*Modulator, 0, len(mod.modulators)),
+		Routes:     make([]*ModRoute, 0, len(mod.routes)),
+	}
+	for _, m := range mod.modulators {
+		mcopy := *m
+		p.Modulators = append(p.Modulators, &mcopy)
+	}
+	for _, rt := range mod.routes {
+		rcopy := *rt
+		p.Routes = append(p.Routes, &rcopy)
+	}
+	return p
+}
+
+// SetPreset replaces all the Modulators and routes
+func (mod *Modulation) SetPreset(p *ModulationPreset) error {
+	modulators := make(map[string]*Modulator)
+	for _, m := range p.Modulators {
+		if err := m.validate(); err != nil {
+			return err
+		}
+		m.idle = true
+		modulators[m.Name] = m
+	}
+	for _, rt := range p.Routes {
+		if _, ok := modulators[rt.Modulator]; !ok {
+			return fmt.Errorf("route to %s.%s uses unknown modulator %s", rt.Region, rt.Param, rt.Modulator)
+		}
+	}
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	mod.modulators = modulators
+	mod.routes = p.Routes
+	return nil
+}
+
+// regionPreset returns the routes to a region, and the Modulators they use
+func (mod *Modulation) regionPreset(region string) *ModulationPreset {
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	p := &ModulationPreset{}
+	used := make(map[string]bool)
+	for _, rt := range mod.routes {
+		if rt.Region != region {
+			continue
+		}
+		rcopy := *rt
+		p.Routes = append(p.Routes, &rcopy)
+		if m, ok := mod.modulators[rt.Modulator]; ok && !used[m.Name] {
+			used[m.Name] = true
+			mcopy := *m
+			p.Modulators = append(p.Modulators, &mcopy)
+		}
+	}
+	return p
+}
+
+// setRegionPreset replaces the routes to a region (e.g. from a snap preset
+// saved in another region), adding or replacing the Modulators they use
+func (mod *Modulation) setRegionPreset(region string, p *ModulationPreset) error {
+	names := make(map[string]bool)
+	for _, m := range p.Modulators {
+		if err := m.validate(); err != nil {
+			return err
+		}
+		names[m.Name] = true
+	}
+	mod.mutex.Lock()
+	defer mod.mutex.Unlock()
+	for _, rt := range p.Routes {
+		if _, ok := mod.modulators[rt.Modulator]; !ok && !names[rt.Modulator] {
+			return fmt.Errorf("route to %s uses unknown modulator %s", rt.Param, rt.Modulator)
+		}
+	}
+	for _, m := range p.Modulators {
+		m.idle = true
+		mod.modulators[m.Name] = m
+	}
+	routes := make([]*ModRoute, 0, len(mod.routes)+len(p.Routes))
+	for _, rt := range mod.routes {
+		if rt.Region != region {
+			routes = append(routes, rt)
+		}
+	}
+	for _, rt := range p.Routes {
+		rcopy := *rt
+		rcopy.Region = region
+		routes = append(routes, &rcopy)
+	}
+	mod.routes = routes
+	return nil
+}
+
+// LoadModulation reads a presets/modulation file
+func (mod *Modulation) LoadModulation(name string) error {
+	path := PresetFilePath("modulation", name)
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("LoadModulation: unable to read path=%s", path)
+	}
+	var p ModulationPreset
+	err = json.Unmarshal(bytes, &p)
+	if err != nil {
+		return fmt.Errorf("LoadModulation: unable to Unmarshal path=%s, err=%s", path, err)
+	}
+	return mod.SetPreset(&p)
+}
+
+// SaveModulation writes a presets/modulation file in the local presets directory
+func (mod *Modulation) SaveModulation(name string) error {
+	path := LocalPresetFilePath("modulation", name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("SaveModulation: unable to create dir for path=%s, err=%s", path, err)
+	}
+	bytes, err := json.MarshalIndent(mod.Preset(), "", "    ")
+	if err != nil {
+		return fmt.Errorf("SaveModulation: err=%s", err)
+	}
+	err = ioutil.WriteFile(path, bytes, 0644)
+	if err != nil {
+		return fmt.Errorf("SaveModulation: unable to write path=%s, err=%s", path, err)
+	}
+	log.Printf("SaveModulation: saved path=%s\n", path)
+	return nil
+}
+
+// modulationAPI handles the global mod_* APIs
+func (r *Router) modulationAPI(apisuffix string, api string, args map[string]string) (result interface{}, err error) {
+	mod := r.modulation
+	switch apisuffix {
+
+	case "mod_set":
+		m := &Modulator{
+			Type:   OptionalStringArg("type", args, "lfo"),
+			Shape:  OptionalStringArg("shape", args, "sine"),
+			Region: OptionalStringArg("region", args, ""),
+		}
+		m.Name, err = NeedStringArg("name", api, args)
+		if err != nil {
+			return nil, err
+		}
+		floats := map[string]*float32{
+			"rate": &m.Rate, "attack": &m.Attack, "decay": &m.Decay,
+			"sustain": &m.Sustain, "release": &m.Release,
+		}
+		// Defaults, for the args that aren't given
+		m.Rate, m.Attack, m.Decay, m.Sustain, m.Release = 4.0, 0.25, 0.5, 0.7, 1.0
+		for nm, f := range floats {
+			if _, ok := args[nm]; ok {
+				*f, err = NeedFloatArg(nm, api, args)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		err = mod.setModulator(m)
+
+	case "mod_delete":
+		var name string
+		name, err = NeedStringArg("name", api, args)
+		if err == nil {
+			err = mod.deleteModulator(name)
+		}
+
+	case "mod_route":
+		route := &ModRoute{}
+		route.Modulator, err = NeedStringArg("modulator", api, args)
+		if err == nil {
+			route.Region, err = NeedStringArg("region", api, args)
+		}
+		if err == nil {
+			route.Param, err = NeedStringArg("param", api, args)
+		}
+		if err == nil {
+			route.Depth, err = NeedFloatArg("depth", api, args)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reactor, ok := r.reactors[route.Region]
+		if !ok {
+			return nil, fmt.Errorf("api=%s there is no region named %s", api, route.Region)
+		}
+		_, _, err = reactor.params.paramNumericValue(route.Param)
+		if err != nil {
+			return nil, err
+		}
+		mod.mutex.Lock()
+		_, ok = mod.modulators[route.Modulator]
+		mod.mutex.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("api=%s there is no modulator named %s", api, route.Modulator)
+		}
+		mod.setRoute(route)
+
+	case "mod_unroute":
+		var modulator, region, param string
+		modulator, err = NeedStringArg("modulator", api, args)
+		if err == nil {
+			region, err = NeedStringArg("region", api, args)
+		}
+		if err == nil {
+			param, err = NeedStringArg("param", api, args)
+		}
+		if err == nil {
+			mod.deleteRoute(modulator, region, param)
+		}
+
+	case "mod_list":
+		result = mod.Preset()
+
+	case "mod_clear":
+		err = mod.SetPreset(&ModulationPreset{})
+
+	case "mod_load":
+		var name string
+		name, err = NeedStringArg("name", api, args)
+		if err == nil {
+			err = mod.LoadModulation(name)
+		}
+
+	case "mod_save":
+		var name string
+		name, err = NeedStringArg("name", api, args)
+		if err == nil {
+			err = mod.SaveModulation(name)
+		}
+
+	default:
+		return nil, fmt.Errorf("Router.modulationAPI: unknown api=%s", api)
+	}
+	return result, err
+}
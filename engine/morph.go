@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// presetMorph interpolates the parameters of a region between two presets
+type presetMorph struct {
+	mutex    sync.Mutex
+	category string
+	nameA    string
+	nameB    string
+	a        map[string]string // full parameter names are the keys
+	b        map[string]string
+	last     map[string]string // the values set by the last morph
+}
+
+// morphPresets is the morph_presets API, which reads the two presets
+// and then sets the parameters for the current value of misc.morph
+func (r *Reactor) morphPresets(api string, args map[string]string) error {
+	category, err := NeedStringArg("category", api, args)
+	if err != nil {
+		return err
+	}
+	if _, ok := presetCategories[category]; !ok {
+		return fmt.Errorf("api=%s unknown preset category %s", api, category)
+	}
+	nameA, err := NeedStringArg("a", api, args)
+	if err != nil {
+		return err
+	}
+	nameB, err := NeedStringArg("b", api, args)
+	if err != nil {
+		return err
+	}
+	_, _, a, _, err := ReadPreset(category, nameA)
+	if err != nil {
+		return err
+	}
+	_, _, b, _, err := ReadPreset(category, nameB)
+	if err != nil {
+		return err
+	}
+	m := r.morph
+	m.mutex.Lock()
+	m.category = category
+	m.nameA = nameA
+	m.nameB = nameB
+	m.a = a
+	m.b = b
+	m.last = make(map[string]string)
+	m.mutex.Unlock()
+
+	r.applyMorph()
+	return nil
+}
+
+// morphClear is the morph_clear API
+func (r *Reactor) morphClear() {
+	m := r.morph
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.a = nil
+	m.b = nil
+	m.last = nil
+}
+
+// setMorph is the morph API
+func (r *Reactor) setMorph(api string, args map[string]string) error {
+	amount, err := NeedFloatArg("amount", api, args)
+	if err != nil {
+		return err
+	}
+	r.cancelRamp("misc.morph")
+	return r.applyParam("misc.morph", fmt.Sprintf("%f", amount))
+}
+
+// morphFromGesture sets misc.morph from the gesture axis given by misc.morphaxis
+func (r *Reactor) morphFromGesture(ce GestureStepEvent) {
+	if ce.Downdragup == "up" {
+		return
+	}
+	var amount float32
+	switch r.params.ParamStringValue("misc.morphaxis", "none") {
+	case "x":
+		amount = ce.X
+	case "y":
+		amount = ce.Y
+	case "z":
+		amount = ce.Z
+	default:
+		return
+	}
+	r.cancelRamp("misc.morph")
+	err := r.applyParam("misc.morph", fmt.Sprintf("%f", clamp01(amount)))
+	if err != nil {
+		log.Printf("Reactor.morphFromGesture: err=%s\n", err)
+	}
+}
+
+// applyMorph sets the parameters of the region for the current value of misc.morph.
+// Numeric parameters are interpolated, and booleans and enums switch
+// from the first preset to the second at misc.morphthreshold.
+func (r *Reactor) applyMorph() {
+	m := r.morph
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.a == nil || m.b == nil {
+		return
+	}
+	amount := r.params.ParamFloatValue("misc.morph")
+	threshold := r.params.ParamFloatValue("misc.morphthreshold")
+
+	changed := make(map[string]string)
+	morphOne := func(name, va, vb string) {
+		if strings.HasPrefix(name, "misc.morph") {
+			// The morph doesn't morph itself
+			return
+		}
+		value := r.morphValue(name, va, vb, amount, threshold)
+		if m.last[name] != value {
+			m.last[name] = value
+			changed[name] = value
+		}
+	}
+	for name, va := range m.a {
+		vb, ok := m.b[name]
+		if !ok {
+			vb = va
+		}
+		morphOne(name, va, vb)
+	}
+	for name, vb := range m.b {
+		if _, ok := m.a[name]; !ok {
+			morphOne(name, vb, vb)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	_, errs := r.setParamValues(changed)
+	for name, err := range errs {
+		log.Printf("Reactor.applyMorph: region=%s param=%s err=%s\n", r.padName, name, err)
+	}
+}
+
+// morphValue returns the value of a parameter, amount of the way from va to vb
+func (r *Reactor) morphValue(name, va, vb string, amount, threshold float32) string {
+	pick := va
+	if amount >= threshold {
+		pick = vb
+	}
+	def, err := r.params.paramDefOf(name)
+	if err != nil {
+		return pick
+	}
+	switch def.typedParamDef.(type) {
+	case paramDefInt, paramDefFloat:
+		fa, erra := ParseFloat32(va, name)
+		fb, errb := ParseFloat32(vb, name)
+		if erra != nil || errb != nil {
+			return pick
+		}
+		v := fa + (fb-fa)*amount
+		if _, isInt := def.typedParamDef.(paramDefInt); isInt {
+			if v < 0 {
+				return strconv.Itoa(int(v - 0.5))
+			}
+			return strconv.Itoa(int(v + 0.5))
+		}
+		return fmt.Sprintf("%.3f", v)
+	default:
+		return pick
+	}
+}
@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+)
+
+// noteTracker is a ledger of the notes currently sounding on each synth.
+// Multiple NOTEONs of the same pitch on the same synth are reference-counted,
+// and only the NOTEOFF that balances the last of them is actually sent.
+// That way, one gesture (or MIDI file) can't cut off a note that
+// another one is still holding.
+type noteTracker struct {
+	mutex    sync.Mutex
+	sounding map[string]*[128]int // synth name is the key
+}
+
+func newNoteTracker() *noteTracker {
+	return &noteTracker{
+		sounding: make(map[string]*[128]int),
+	}
+}
+
+// noteOn records a NOTEON
+func (t *noteTracker) noteOn(synth string, pitch uint8) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	counts, ok := t.sounding[synth]
+	if !ok {
+		counts = &[128]int{}
+		t.sounding[synth] = counts
+	}
+	counts[pitch&0x7f]++
+}
+
+// noteOff records a NOTEOFF, and returns true if the NOTEOFF
+// should actually be sent, i.e. if it balances the last NOTEON
+// of that pitch.  NOTEOFFs for notes that aren't sounding return false.
+func (t *noteTracker) noteOff(synth string, pitch uint8) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	counts, ok := t.sounding[synth]
+	if !ok || counts[pitch&0x7f] <= 0 {
+		return false
+	}
+	counts[pitch&0x7f]--
+	return counts[pitch&0x7f] == 0
+}
+
+// clear forgets all the notes sounding on a synth,
+// and returns the pitches that were sounding.
+func (t *noteTracker) clear(synth string) []uint8 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	counts, ok := t.sounding[synth]
+	if !ok {
+		return nil
+	}
+	delete(t.sounding, synth)
+	var pitches []uint8
+	for p, n := range counts {
+		if n > 0 {
+			pitches = append(pitches, uint8(p))
+		}
+	}
+	return pitches
+}
+
+// synths returns the names of all synths that have had notes tracked
+func (t *noteTracker) synths() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	names := make([]string, 0, len(t.sounding))
+	for nm := range t.sounding {
+		names = append(names, nm)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// soundingNotes returns the currently-sounding pitches for each synth.
+// Pitches that have been turned on more than once are listed more than once.
+func (t *noteTracker) soundingNotes() map[string][]int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	notes := make(map[string][]int)
+	for nm, counts := range t.sounding {
+		var pitches []int
+		for p, n := range counts {
+			for i := 0; i < n; i++ {
+				pitches = append(pitches, p)
+			}
+		}
+		if len(pitches) > 0 {
+			notes[nm] = pitches
+		}
+	}
+	return notes
+}
@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hypebeast/go-osc/osc"
+)
+
+// defaultParamNotifyMillisecs is how often parameter changes are published,
+// if paramnotifyms isn't in settings.json
+const defaultParamNotifyMillisecs = 50
+
+// paramChange is a parameter change waiting to be published
+type paramChange struct {
+	region   string
+	name     string
+	oldvalue string
+	newvalue string
+}
+
+// paramNotifier publishes parameter changes to the GUI (over OSC)
+// and to NATS.  Changes are collected and published periodically,
+// so a parameter that's ramping (or changing on every click for
+// any other reason) only gets published once per period, with the value
+// it had at the start of the period as the old value.
+type paramNotifier struct {
+	mutex    sync.Mutex
+	pending  map[string]*paramChange // region.name is the key
+	order    []string                // keys of pending, in the order they changed
+	interval time.Duration
+}
+
+func newParamNotifier() *paramNotifier {
+	ms, err := strconv.Atoi(ConfigValue("paramnotifyms"))
+	if err != nil || ms <= 0 {
+		ms = defaultParamNotifyMillisecs
+	}
+	return &paramNotifier{
+		pending:  make(map[string]*paramChange),
+		interval: time.Duration(ms) * time.Millisecond,
+	}
+}
+
+// changed is the ParamObserver of each region
+func (pn *paramNotifier) changed(region, name, oldvalue, newvalue string) {
+	pn.mutex.Lock()
+	defer pn.mutex.Unlock()
+	key := region + "." + name
+	if pc, ok := pn.pending[key]; ok {
+		pc.newvalue = newvalue
+		return
+	}
+	pn.pending[key] = &paramChange{region: region, name: name, oldvalue: oldvalue, newvalue: newvalue}
+	pn.order = append(pn.order, key)
+}
+
+// run publishes the pending changes, and never returns
+func (pn *paramNotifier) run(guiClient *osc.Client) {
+	for {
+		time.Sleep(pn.interval)
+
+		pn.mutex.Lock()
+		changes := make([]*paramChange, 0, len(pn.order))
+		for _, key := range pn.order {
+			pc := pn.pending[key]
+			// A parameter that changed and then changed back isn't published
+			if pc.oldvalue != pc.newvalue {
+				changes = append(changes, pc)
+			}
+		}
+		pn.pending = make(map[string]*paramChange)
+		pn.order = nil
+		pn.mutex.Unlock()
+
+		for _, pc := range changes {
+			publishParamChange(guiClient, pc)
+		}
+	}
+}
+
+// publishParamChange sends a parameter change to the GUI (if notifygui is set) and to NATS
+func publishParamChange(guiClient *osc.Client, pc *paramChange) {
+	if ConfigBool("notifygui") {
+		msg := osc.NewMessage("/param")
+		msg.Append(pc.region)
+		msg.Append(pc.name)
+		msg.Append(pc.oldvalue)
+		msg.Append(pc.newvalue)
+		guiClient.Send(msg)
+		if DebugUtil.OSC {
+			log.Printf("publishParamChange: msg=%v\n", msg)
+		}
+	}
+
+	if TheVizNats == nil {
+		return
+	}
+	dt := time.Now().Sub(time0)
+	params := "{ " +
+		"\"nuid\": \"" + MyNUID() + "\", " +
+		"\"event\": \"param\", " +
+		"\"region\": \"" + jsonEscape(pc.region) + "\", " +
+		"\"millisecs\": \"" + fmt.Sprintf("%d", dt.Milliseconds()) + "\", " +
+		"\"name\": \"" + jsonEscape(pc.name) + "\", " +
+		"\"old\": \"" + jsonEscape(pc.oldvalue) + "\", " +
+		"\"new\": \"" + jsonEscape(pc.newvalue) + "\" }"
+	err := TheVizNats.Publish(MontageEventSubject, params)
+	if err != nil && DebugUtil.NATS {
+		log.Printf("publishParamChange: err=%s\n", err)
+	}
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParamDescription describes a parameter, for the describe_params API
+type ParamDescription struct {
+	Type    string   `json:"type"` // "int", "float", "bool", or "string"
+	Min     string   `json:"min,omitempty"`
+	Max     string   `json:"max,omitempty"`
+	Enum    []string `json:"enum,omitempty"`
+	Init    string   `json:"init"`
+	Comment string   `json:"comment,omitempty"`
+}
+
+// ParamNames returns the sorted names of all the parameters
+// that start with prefix (e.g. "visual."), or all of them if prefix is "".
+// Each effect parameter is there twice, as effect.1-* and effect.2-*
+func ParamNames(prefix string) []string {
+	var names []string
+	for _, name := range paramDefNames() {
+		if strings.HasPrefix(name, "effect.") {
+			base := strings.TrimPrefix(name, "effect.")
+			for _, nm := range []string{"effect.1-" + base, "effect.2-" + base} {
+				if strings.HasPrefix(nm, prefix) {
+					names = append(names, nm)
+				}
+			}
+		} else if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DescribeParam returns the description of a parameter
+func DescribeParam(def ParamDef) *ParamDescription {
+	desc := &ParamDescription{
+		Init:    def.Init,
+		Comment: strings.TrimSpace(strings.TrimPrefix(def.Comment, "#")),
+	}
+	switch d := def.typedParamDef.(type) {
+	case paramDefInt:
+		desc.Type = "int"
+		desc.Min = strconv.Itoa(d.min)
+		desc.Max = strconv.Itoa(d.max)
+	case paramDefFloat:
+		desc.Type = "float"
+		desc.Min = strconv.FormatFloat(float64(d.min), 'f', -1, 32)
+		desc.Max = strconv.FormatFloat(float64(d.max), 'f', -1, 32)
+	case paramDefBool:
+		desc.Type = "bool"
+	case paramDefString:
+		desc.Type = "string"
+		desc.Enum = d.values
+	}
+	return desc
+}
+
+// describeParams is the global describe_params API, with an optional
+// prefix arg (e.g. "visual.").  Effect parameters are described once,
+// as effect.*, since effect.1-* and effect.2-* are the same.
+func describeParams(args map[string]string) map[string]*ParamDescription {
+	prefix := OptionalStringArg("prefix", args, "")
+	descs := make(map[string]*ParamDescription)
+	paramDefsMutex.RLock()
+	defer paramDefsMutex.RUnlock()
+	for name, def := range ParamDefs {
+		if strings.HasPrefix(name, prefix) {
+			descs[name] = DescribeParam(def)
+		}
+	}
+	return descs
+}
+
+// getParam is the get_param API
+func (r *Reactor) getParam(api string, args map[string]string) (string, error) {
+	name, err := NeedStringArg("param", api, args)
+	if err != nil {
+		return "", err
+	}
+	return r.params.paramValueString(name)
+}
+
+// getParams is the get_params API, with an optional prefix arg (e.g. "visual.").
+// The result is a JSON object with the values of the parameters.
+func (r *Reactor) getParams(api string, args map[string]string) (string, error) {
+	prefix := OptionalStringArg("prefix", args, "")
+	values := make(map[string]string)
+	for _, name := range ParamNames(prefix) {
+		value, err := r.params.paramValueString(name)
+		if err != nil {
+			return "", err
+		}
+		values[name] = value
+	}
+	bytes, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("Reactor.getParams: err=%s", err)
+	}
+	return string(bytes), nil
+}
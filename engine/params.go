@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,7 +19,7 @@ type ParamDef struct {
 	typedParamDef interface{}
 	Category      string
 	Init          string
-	comment       string
+	Comment       string
 }
 
 type paramDefFloat struct {
@@ -36,13 +38,36 @@ type paramDefBool struct {
 }
 
 type paramDefString struct {
-	values []string
+	enumName string
+	values   []string
 	// callback func(router *Router, reactor *Reactor, name, value string) error
 }
 
 // ParamDefs is the set of all parameter definitions
 var ParamDefs map[string]ParamDef
 
+// paramDefsMutex protects ParamDefs and ParamEnums, which
+// change when the scales or velocity curves are reloaded
+var paramDefsMutex sync.RWMutex
+
+// lookupParamDef returns the ParamDef of a parameter
+func lookupParamDef(name string) ParamDef {
+	paramDefsMutex.RLock()
+	defer paramDefsMutex.RUnlock()
+	return ParamDefs[name]
+}
+
+// paramDefNames returns the names of all the parameter definitions
+func paramDefNames() []string {
+	paramDefsMutex.RLock()
+	defer paramDefsMutex.RUnlock()
+	names := make([]string, 0, len(ParamDefs))
+	for nm := range ParamDefs {
+		names = append(names, nm)
+	}
+	return names
+}
+
 // parameter values
 
 // ParamValue is a single parameter value
@@ -71,24 +96,156 @@ type paramValBool struct {
 
 // ParamValues is the set of all parameter values
 type ParamValues struct {
-	mutex  sync.RWMutex
-	values map[string]ParamValue
+	mutex     sync.RWMutex
+	values    map[string]ParamValue
+	offsets   map[string]float32 // from modulators, added to int and float values when they're read
+	observers []ParamObserver
+	// A region's values have the global values as their parent, which are used
+	// for the parameters that haven't been set (overridden) in the region
+	parent    *ParamValues
+	overrides map[string]bool
 }
 
+// ParamObserver is called after a parameter value changes.
+// The values are formatted as in preset files.
+type ParamObserver func(name string, oldvalue string, newvalue string)
+
 // NewParamValues creates a new ParamValues
 func NewParamValues() *ParamValues {
 	return &ParamValues{
-		values: make(map[string]ParamValue),
+		values:    make(map[string]ParamValue),
+		offsets:   make(map[string]float32),
+		overrides: make(map[string]bool),
+	}
+}
+
+// SetParent makes parent the source of values for the parameters
+// that haven't been set in vals
+func (vals *ParamValues) SetParent(parent *ParamValues) {
+	vals.mutex.Lock()
+	defer vals.mutex.Unlock()
+	vals.parent = parent
+}
+
+// valueOf returns the value of a parameter, from the parent if the parameter
+// hasn't been overridden and the parent has a value.  vals.mutex must be held.
+func (vals *ParamValues) valueOf(name string) ParamValue {
+	if vals.parent != nil && !vals.overrides[name] {
+		if val := vals.parent.paramValue(name); val != nil {
+			return val
+		}
+	}
+	return vals.values[name]
+}
+
+// IsOverridden returns true if a parameter has been set in vals,
+// rather than coming from the parent
+func (vals *ParamValues) IsOverridden(name string) bool {
+	vals.mutex.RLock()
+	defer vals.mutex.RUnlock()
+	return vals.overrides[name]
+}
+
+// ClearOverride makes a parameter come from the parent again
+// (or go back to its initial value, if the parent doesn't have one),
+// and returns its value before and after
+func (vals *ParamValues) ClearOverride(name string) (oldval ParamValue, newval ParamValue) {
+	vals.mutex.Lock()
+	oldval = vals.valueOf(name)
+	def, err := vals.paramDefOf(name)
+	if err == nil && def.typedParamDef != nil {
+		_, err = vals.realSetParamValueWithString(name, def.Init, nil, false /*no lock*/)
+		if err != nil {
+			log.Printf("ClearOverride: bad init value for %s, err=%s\n", name, err)
+		}
+	}
+	delete(vals.overrides, name)
+	newval = vals.valueOf(name)
+	vals.mutex.Unlock()
+	vals.notifyObservers(name, oldval, newval)
+	return oldval, newval
+}
+
+// Overrides returns the names of the parameters that have been set in vals
+func (vals *ParamValues) Overrides() []string {
+	vals.mutex.RLock()
+	defer vals.mutex.RUnlock()
+	names := make([]string, 0, len(vals.overrides))
+	for name := range vals.overrides {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
+
+// DeleteParamValue removes the value of a parameter, e.g. a global one
+func (vals *ParamValues) DeleteParamValue(name string) {
+	vals.mutex.Lock()
+	defer vals.mutex.Unlock()
+	delete(vals.values, name)
+	delete(vals.overrides, name)
+}
+
+// AddObserver registers a function to be called whenever a parameter changes
+func (vals *ParamValues) AddObserver(observer ParamObserver) {
+	vals.mutex.Lock()
+	defer vals.mutex.Unlock()
+	vals.observers = append(vals.observers, observer)
+}
+
+// notifyObservers calls the observers if the value of a parameter has changed
+func (vals *ParamValues) notifyObservers(name string, oldval, newval ParamValue) {
+	vals.mutex.RLock()
+	observers := vals.observers
+	vals.mutex.RUnlock()
+	if len(observers) == 0 {
+		return
+	}
+	newvalue := formatParamValue(newval)
+	oldvalue := newvalue
+	if oldval != nil {
+		oldvalue = formatParamValue(oldval)
+	}
+	if oldvalue == newvalue {
+		return
+	}
+	for _, observer := range observers {
+		observer(name, oldvalue, newvalue)
+	}
+}
+
+// SetParamOffset sets the amount that a modulator adds to a parameter,
+// without changing its (base) value.  An offset of 0 removes it.
+func (vals *ParamValues) SetParamOffset(name string, offset float32) {
+	vals.mutex.Lock()
+	defer vals.mutex.Unlock()
+	if offset == 0 {
+		delete(vals.offsets, name)
+	} else {
+		vals.offsets[name] = offset
+	}
+}
+
+func (vals *ParamValues) paramOffset(name string) float32 {
+	vals.mutex.RLock()
+	defer vals.mutex.RUnlock()
+	return vals.offsets[name]
 }
 
 // SetDefaultValues xxx
 func (vals *ParamValues) SetDefaultValues() {
+	names := paramDefNames()
 	vals.mutex.Lock()
-	for nm, d := range ParamDefs {
+	for _, nm := range names {
+		d := lookupParamDef(nm)
 		// log.Printf("setDefault nm=%s val=%v\n", nm, d.Init)
-		vals.realSetParamValueWithString(nm, d.Init, nil, false /*no lock*/)
+		_, err := vals.realSetParamValueWithString(nm, d.Init, nil, false /*no lock*/)
+		if err != nil {
+			log.Printf("SetDefaultValues: bad init value for %s, err=%s\n", nm, err)
+		}
 	}
+	// The default values don't override the parent's values
+	vals.overrides = make(map[string]bool)
 	vals.mutex.Unlock()
 }
 
@@ -97,7 +254,39 @@ type ParamCallback func(name string, value string) error
 
 // SetParamValueWithString xxx
 func (vals *ParamValues) SetParamValueWithString(name, value string, callback ParamCallback) error {
-	return vals.realSetParamValueWithString(name, value, callback, true)
+	_, err := vals.realSetParamValueWithString(name, value, callback, true)
+	return err
+}
+
+// SetParamValues sets many parameters at once, so that nothing
+// sees some of the new values without the others.  Invalid values
+// aren't set, and their errors are returned (the parameter name is the key).
+// The values that weren't valid but were set anyway (see paramvalidation)
+// are in warnings.
+func (vals *ParamValues) SetParamValues(values map[string]string) (warnings map[string]string, errs map[string]error) {
+	staged := NewParamValues()
+	warnings = make(map[string]string)
+	errs = make(map[string]error)
+	for name, value := range values {
+		warning, err := staged.realSetParamValueWithString(name, value, nil, false)
+		if err != nil {
+			errs[name] = err
+		} else if warning != "" {
+			warnings[name] = warning
+		}
+	}
+	oldvals := make(map[string]ParamValue)
+	vals.mutex.Lock()
+	for name, val := range staged.values {
+		oldvals[name] = vals.valueOf(name)
+		vals.values[name] = val
+		vals.overrides[name] = true
+	}
+	vals.mutex.Unlock()
+	for name, val := range staged.values {
+		vals.notifyObservers(name, oldvals[name], val)
+	}
+	return warnings, errs
 }
 
 func (vals *ParamValues) paramDefOf(origname string) (ParamDef, error) {
@@ -127,20 +316,22 @@ func (vals *ParamValues) paramDefOf(origname string) (ParamDef, error) {
 		}
 		realParamName = strings.Replace(origname, toreplace, base, 1)
 	}
-	return ParamDefs[realParamName], nil
+	return lookupParamDef(realParamName), nil
 }
 
 // realSetParamValueWithString xxx
-func (vals *ParamValues) realSetParamValueWithString(origname, value string, callback ParamCallback, lockit bool) (err error) {
+// If the value isn't valid but is set anyway (see paramvalidation),
+// warning says so, and what value was used.
+func (vals *ParamValues) realSetParamValueWithString(origname, value string, callback ParamCallback, lockit bool) (warning string, err error) {
 
 	// log.Printf("realSetParamValueWithString: %s %s\n", name, value)
 	if origname == "pad" {
-		return fmt.Errorf("ParamValues.SetParamValueWithString rejects setting of pad value")
+		return "", fmt.Errorf("ParamValues.SetParamValueWithString rejects setting of pad value")
 	}
 
 	def, err := vals.paramDefOf(origname)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	var paramVal ParamValue
@@ -148,50 +339,132 @@ func (vals *ParamValues) realSetParamValueWithString(origname, value string, cal
 	case paramDefInt:
 		valint, err := strconv.Atoi(value)
 		if err != nil {
-			return err
+			return "", fmt.Errorf("parameter %s: value %s is not an int", origname, value)
+		}
+		if valint < d.min || valint > d.max {
+			invalid := fmt.Errorf("parameter %s: value %d is outside %d-%d", origname, valint, d.min, d.max)
+			clamp, err := paramInvalid(invalid)
+			if err != nil {
+				return "", err
+			}
+			warning = invalid.Error()
+			if clamp {
+				valint = clampInt(valint, d.min, d.max)
+				warning += fmt.Sprintf(", using %d", valint)
+			}
 		}
 		paramVal = paramValInt{def: d, value: valint}
 	case paramDefBool:
 		v, err := strconv.ParseBool(value)
 		if err != nil {
-			return err
+			return "", fmt.Errorf("parameter %s: value %s is not a bool", origname, value)
 		}
 		paramVal = paramValBool{def: d, value: v}
 	case paramDefString:
+		if !d.allows(value) {
+			invalid := fmt.Errorf("parameter %s: value %s is not one of %s", origname, value, strings.Join(d.values, ","))
+			clamp, err := paramInvalid(invalid)
+			if err != nil {
+				return "", err
+			}
+			warning = invalid.Error()
+			if clamp {
+				// There's no nearest value for strings, so it goes back to the initial value
+				value = def.Init
+				warning += fmt.Sprintf(", using %s", value)
+			}
+		}
 		paramVal = paramValString{def: d, value: value}
 	case paramDefFloat:
 		var v float32
 		v, err := ParseFloat32(value, origname)
 		if err != nil {
-			return err
+			return "", err
+		}
+		if v < d.min || v > d.max {
+			invalid := fmt.Errorf("parameter %s: value %f is outside %f-%f", origname, v, d.min, d.max)
+			clamp, err := paramInvalid(invalid)
+			if err != nil {
+				return "", err
+			}
+			warning = invalid.Error()
+			if clamp {
+				if v < d.min {
+					v = d.min
+				} else {
+					v = d.max
+				}
+				warning += fmt.Sprintf(", using %f", v)
+			}
 		}
 		paramVal = paramValFloat{def: d, value: float32(v)}
 	default:
-		log.Printf("SetParamValueWithString: unknown type of ParamDef for name=%s", origname)
-		return fmt.Errorf("SetParamValueWithString: unknown type of ParamDef for name=%s", origname)
+		return "", fmt.Errorf("SetParamValueWithString: unknown parameter %s", origname)
 	}
 
 	// Perhaps the callback should be inside the Lock?
 	if callback != nil {
 		err := callback(origname, value)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 
 	if lockit {
 		vals.mutex.Lock()
 	}
+	oldVal := vals.valueOf(origname)
 	vals.values[origname] = paramVal
+	vals.overrides[origname] = true
 	if lockit {
 		vals.mutex.Unlock()
+		vals.notifyObservers(origname, oldVal, paramVal)
 	}
-	return nil
+	return warning, nil
 }
 
 // ParamEnums contains the lists of enumerated values for string parameters
 var ParamEnums map[string][]string
 
+// openParamEnums are enums whose lists are just examples,
+// since the real values depend on the synths and MIDI devices
+var openParamEnums = map[string]bool{
+	"synth":     true,
+	"inputport": true,
+}
+
+// allows returns true if value is one of the enum values,
+// or if the parameter doesn't have a fixed list of values
+func (d paramDefString) allows(value string) bool {
+	if len(d.values) == 0 || openParamEnums[d.enumName] {
+		return true
+	}
+	for _, v := range d.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// paramInvalid applies the paramvalidation setting to a value that's
+// out of range or not one of the enum values.  It returns an error
+// if the value should be rejected ("reject"), and clamp is true if the
+// value should be replaced by the closest valid one ("clamp", the default).
+// With "warn", the value is used as-is.
+func paramInvalid(err error) (clamp bool, rerr error) {
+	switch policy := ConfigValue("paramvalidation"); policy {
+	case "reject":
+		return false, err
+	case "warn":
+		log.Printf("ParamValues: %s\n", err)
+		return false, nil
+	default: // "clamp"
+		log.Printf("ParamValues: %s, using the closest valid value (paramvalidation=%s)\n", err, policy)
+		return true, nil
+	}
+}
+
 // ResolumeJSON is an unmarshalled version of the resolume.json file
 var ResolumeJSON map[string]interface{}
 
@@ -241,7 +514,7 @@ func ParseBool(s string, name string) (bool, error) {
 // LoadParamEnums initializes the list of enumerated parameter values
 func LoadParamEnums() error {
 
-	ParamEnums = make(map[string][]string)
+	paramEnums := make(map[string][]string)
 
 	path := ConfigFilePath("paramenums.json")
 	bytes, err := ioutil.ReadFile(path)
@@ -260,15 +533,42 @@ func LoadParamEnums() error {
 		for _, e := range enumList.([]interface{}) {
 			enums = append(enums, e.(string))
 		}
-		ParamEnums[enumName] = enums
+		paramEnums[enumName] = enums
 	}
+	// The scale values come from the scales that are loaded
+	paramEnums["scale"] = scaleEnum()
+	paramEnums["velocitycurve"] = velocityCurveEnum()
+
+	paramDefsMutex.Lock()
+	ParamEnums = paramEnums
+	paramDefsMutex.Unlock()
 	return nil
 }
 
+// SetParamEnum replaces the list of values of an enumerated type,
+// including in the definitions of parameters that use it
+func SetParamEnum(enumName string, values []string) {
+	paramDefsMutex.Lock()
+	defer paramDefsMutex.Unlock()
+	if ParamEnums == nil {
+		// The enums haven't been loaded yet
+		return
+	}
+	ParamEnums[enumName] = values
+	for nm, pd := range ParamDefs {
+		d, ok := pd.typedParamDef.(paramDefString)
+		if ok && d.enumName == enumName {
+			d.values = values
+			pd.typedParamDef = d
+			ParamDefs[nm] = pd
+		}
+	}
+}
+
 // LoadParamDefs initializes the list of parameters
 func LoadParamDefs() error {
 
-	ParamDefs = make(map[string]ParamDef)
+	paramDefs := make(map[string]ParamDef)
 
 	path := ConfigFilePath("paramdefs.json")
 	bytes, err := ioutil.ReadFile(path)
@@ -295,7 +595,7 @@ func LoadParamDefs() error {
 		pd := ParamDef{
 			Category: category,
 			Init:     jmap["init"].(string),
-			comment:  jmap["comment"].(string),
+			Comment:  jmap["comment"].(string),
 		}
 
 		switch valuetype {
@@ -335,27 +635,46 @@ func LoadParamDefs() error {
 			// string parameter definition
 			// is actually an "enum" type name
 			enumName := min
+			paramDefsMutex.RLock()
 			values := ParamEnums[enumName]
+			paramDefsMutex.RUnlock()
 			pd.typedParamDef = paramDefString{
-				values: values,
+				enumName: enumName,
+				values:   values,
 			}
 		}
 
-		ParamDefs[name] = pd
+		paramDefs[name] = pd
 	}
+
+	paramDefsMutex.Lock()
+	ParamDefs = paramDefs
+	paramDefsMutex.Unlock()
 	return nil
 }
 
 func (vals *ParamValues) paramValue(name string) ParamValue {
 	vals.mutex.RLock()
-	val, ok := vals.values[name]
+	val := vals.valueOf(name)
 	vals.mutex.RUnlock()
-	if !ok {
-		return nil
-	}
 	return val
 }
 
+// formatParamValue formats a parameter value as in preset files
+func formatParamValue(val ParamValue) string {
+	switch v := val.(type) {
+	case paramValInt:
+		return strconv.Itoa(v.value)
+	case paramValFloat:
+		return fmt.Sprintf("%.3f", v.value)
+	case paramValBool:
+		return strconv.FormatBool(v.value)
+	case paramValString:
+		return v.value
+	}
+	return ""
+}
+
 // ParamStringValue xxx
 func (vals *ParamValues) ParamStringValue(name string, def string) string {
 	val := vals.paramValue(name)
@@ -365,6 +684,47 @@ func (vals *ParamValues) ParamStringValue(name string, def string) string {
 	return val.(paramValString).value
 }
 
+// paramNumericValue returns the value of an int or float parameter,
+// or its initial value if it hasn't been set
+func (vals *ParamValues) paramNumericValue(name string) (v float32, isInt bool, err error) {
+	switch val := vals.paramValue(name).(type) {
+	case paramValInt:
+		return float32(val.value), true, nil
+	case paramValFloat:
+		return val.value, false, nil
+	case nil:
+		def, err := vals.paramDefOf(name)
+		if err != nil {
+			return 0, false, err
+		}
+		switch def.typedParamDef.(type) {
+		case paramDefInt:
+			i, err := ParseInt(def.Init, name)
+			return float32(i), true, err
+		case paramDefFloat:
+			f, err := ParseFloat32(def.Init, name)
+			return f, false, err
+		}
+	}
+	return 0, false, fmt.Errorf("parameter %s isn't an int or float", name)
+}
+
+// paramValueString returns the (unmodulated) value of a parameter as a string,
+// formatted as in preset files, or its initial value if it hasn't been set
+func (vals *ParamValues) paramValueString(name string) (string, error) {
+	if val := vals.paramValue(name); val != nil {
+		return formatParamValue(val), nil
+	}
+	def, err := vals.paramDefOf(name)
+	if err != nil {
+		return "", err
+	}
+	if def.typedParamDef == nil {
+		return "", fmt.Errorf("unknown parameter %s", name)
+	}
+	return def.Init, nil
+}
+
 // ParamIntValue xxx
 func (vals *ParamValues) ParamIntValue(name string) int {
 	param := vals.paramValue(name)
@@ -372,7 +732,13 @@ func (vals *ParamValues) ParamIntValue(name string) int {
 		log.Printf("**** No existing int value for param name=%s ??\n", name)
 		return 0
 	}
-	return param.(paramValInt).value
+	val := param.(paramValInt)
+	if offset := vals.paramOffset(name); offset != 0 {
+		// Modulation stays within the parameter's range
+		i := int(math.Round(float64(val.value) + float64(offset)))
+		return clampInt(i, val.def.min, val.def.max)
+	}
+	return val.value
 }
 
 // ParamFloatValue xxx
@@ -382,7 +748,17 @@ func (vals *ParamValues) ParamFloatValue(name string) float32 {
 		log.Printf("**** No existing float value for param name=%s ??\n", name)
 		return 0.0
 	}
-	f := (param).(paramValFloat).value
+	val := (param).(paramValFloat)
+	f := val.value
+	if offset := vals.paramOffset(name); offset != 0 {
+		// Modulation stays within the parameter's range
+		f += offset
+		if f < val.def.min {
+			f = val.def.min
+		} else if f > val.def.max {
+			f = val.def.max
+		}
+	}
 	return f
 }
 
@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// saveParamGlobals restores the settings, parameter definitions,
+// scales and velocity curves when the test is done
+func saveParamGlobals(t *testing.T) {
+	t.Helper()
+
+	configMutex.Lock()
+	oldConfigMap := configMap
+	configMutex.Unlock()
+	paramDefsMutex.RLock()
+	oldDefs, oldEnums := ParamDefs, ParamEnums
+	paramDefsMutex.RUnlock()
+	scalesMutex.RLock()
+	oldScales, oldScaleNames := Scales, ScaleNames
+	scalesMutex.RUnlock()
+	velocityCurvesMutex.RLock()
+	oldCurves, oldCurveNames := VelocityCurves, VelocityCurveNames
+	velocityCurvesMutex.RUnlock()
+
+	t.Cleanup(func() {
+		configMutex.Lock()
+		configMap = oldConfigMap
+		configMutex.Unlock()
+		paramDefsMutex.Lock()
+		ParamDefs, ParamEnums = oldDefs, oldEnums
+		paramDefsMutex.Unlock()
+		scalesMutex.Lock()
+		Scales, ScaleNames = oldScales, oldScaleNames
+		scalesMutex.Unlock()
+		velocityCurvesMutex.Lock()
+		VelocityCurves, VelocityCurveNames = oldCurves, oldCurveNames
+		velocityCurvesMutex.Unlock()
+	})
+}
+
+// setTestParams replaces the parameter definitions and the
+// paramvalidation setting with ones for testing
+func setTestParams(t *testing.T, policy string) *ParamValues {
+	t.Helper()
+	saveParamGlobals(t)
+
+	configMutex.Lock()
+	configMap = map[string]string{"paramvalidation": policy}
+	configMutex.Unlock()
+
+	shapes := []string{"line", "triangle", "circle"}
+	paramDefsMutex.Lock()
+	ParamEnums = map[string][]string{"shape": shapes}
+	ParamDefs = map[string]ParamDef{
+		"test.int": {
+			typedParamDef: paramDefInt{min: 0, max: 10},
+			Category:      "test",
+			Init:          "5",
+		},
+		"test.float": {
+			typedParamDef: paramDefFloat{min: -1.0, max: 1.0},
+			Category:      "test",
+			Init:          "0.0",
+		},
+		"test.bool": {
+			typedParamDef: paramDefBool{},
+			Category:      "test",
+			Init:          "false",
+		},
+		"test.shape": {
+			typedParamDef: paramDefString{enumName: "shape", values: shapes},
+			Category:      "test",
+			Init:          "line",
+		},
+	}
+	paramDefsMutex.Unlock()
+
+	vals := NewParamValues()
+	vals.SetDefaultValues()
+	return vals
+}
+
+func TestRealSetParamValueWithString(t *testing.T) {
+
+	tests := []struct {
+		policy   string
+		name     string
+		value    string
+		want     string // the value after setting it
+		wantErr  bool
+		wantWarn bool // the value was adjusted or used anyway
+	}{
+		// in range
+		{"reject", "test.int", "7", "7", false, false},
+		{"clamp", "test.int", "7", "7", false, false},
+		{"warn", "test.int", "7", "7", false, false},
+		{"reject", "test.float", "-0.5", "-0.500", false, false},
+		{"clamp", "test.float", "-0.5", "-0.500", false, false},
+		{"warn", "test.float", "-0.5", "-0.500", false, false},
+		{"reject", "test.bool", "true", "true", false, false},
+		{"clamp", "test.bool", "true", "true", false, false},
+		{"warn", "test.bool", "true", "true", false, false},
+		{"reject", "test.shape", "circle", "circle", false, false},
+		{"clamp", "test.shape", "circle", "circle", false, false},
+		{"warn", "test.shape", "circle", "circle", false, false},
+
+		// out of range
+		{"reject", "test.int", "11", "5", true, false},
+		{"clamp", "test.int", "11", "10", false, true},
+		{"clamp", "test.int", "-3", "0", false, true},
+		{"warn", "test.int", "11", "11", false, true},
+		{"reject", "test.float", "1.5", "0.000", true, false},
+		{"clamp", "test.float", "1.5", "1.000", false, true},
+		{"clamp", "test.float", "-2", "-1.000", false, true},
+		{"warn", "test.float", "1.5", "1.500", false, true},
+		{"reject", "test.shape", "hexagon", "line", true, false},
+		{"clamp", "test.shape", "hexagon", "line", false, true},
+		{"warn", "test.shape", "hexagon", "hexagon", false, true},
+
+		// unparsable, which is an error whatever the policy is
+		{"reject", "test.int", "seven", "5", true, false},
+		{"clamp", "test.int", "seven", "5", true, false},
+		{"warn", "test.int", "seven", "5", true, false},
+		{"reject", "test.int", "7.5", "5", true, false},
+		{"clamp", "test.int", "7.5", "5", true, false},
+		{"warn", "test.int", "7.5", "5", true, false},
+		{"reject", "test.float", "half", "0.000", true, false},
+		{"clamp", "test.float", "half", "0.000", true, false},
+		{"warn", "test.float", "half", "0.000", true, false},
+		{"reject", "test.bool", "maybe", "false", true, false},
+		{"clamp", "test.bool", "maybe", "false", true, false},
+		{"warn", "test.bool", "maybe", "false", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.name+"="+tt.value, func(t *testing.T) {
+			vals := setTestParams(t, tt.policy)
+			warning, err := vals.realSetParamValueWithString(tt.name, tt.value, nil, true)
+			if tt.wantErr && err == nil {
+				t.Errorf("expected an error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if tt.wantWarn && warning == "" {
+				t.Errorf("expected a warning")
+			} else if !tt.wantWarn && warning != "" {
+				t.Errorf("unexpected warning: %s", warning)
+			}
+			got, err := vals.paramValueString(tt.name)
+			if err != nil {
+				t.Fatalf("paramValueString: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("value is %s, expected %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetParamValues(t *testing.T) {
+	vals := setTestParams(t, "clamp")
+	warnings, errs := vals.SetParamValues(map[string]string{
+		"test.int":   "11",
+		"test.float": "0.5",
+		"test.bool":  "maybe",
+	})
+	if len(warnings) != 1 || warnings["test.int"] == "" {
+		t.Errorf("warnings are %v, expected one for test.int", warnings)
+	}
+	if len(errs) != 1 || errs["test.bool"] == nil {
+		t.Errorf("errs are %v, expected one for test.bool", errs)
+	}
+	for name, want := range map[string]string{"test.int": "10", "test.float": "0.500", "test.bool": "false"} {
+		got, err := vals.paramValueString(name)
+		if err != nil {
+			t.Fatalf("paramValueString: %s", err)
+		}
+		if got != want {
+			t.Errorf("%s is %s, expected %s", name, got, want)
+		}
+	}
+}
+
+func TestParamInvalid(t *testing.T) {
+
+	tests := []struct {
+		policy    string
+		wantClamp bool
+		wantErr   bool
+	}{
+		{"reject", false, true},
+		{"clamp", true, false},
+		{"warn", false, false},
+		{"", true, false}, // clamp is the default
+	}
+
+	for _, tt := range tests {
+		t.Run("paramvalidation="+tt.policy, func(t *testing.T) {
+			setTestParams(t, tt.policy)
+			clamp, err := paramInvalid(errTestInvalid)
+			if clamp != tt.wantClamp {
+				t.Errorf("clamp is %v, expected %v", clamp, tt.wantClamp)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err is %v", err)
+			}
+		})
+	}
+}
+
+// TestParamDefsInit checks that the init value of every parameter
+// in the default paramdefs.json is valid
+func TestParamDefsInit(t *testing.T) {
+	saveParamGlobals(t)
+
+	// ConfigFilePath uses MONTAGE_SOURCE to find the default config
+	oldSource, hadSource := os.LookupEnv("MONTAGE_SOURCE")
+	os.Setenv("MONTAGE_SOURCE", "..")
+	t.Cleanup(func() {
+		if hadSource {
+			os.Setenv("MONTAGE_SOURCE", oldSource)
+		} else {
+			os.Unsetenv("MONTAGE_SOURCE")
+		}
+	})
+
+	configMutex.Lock()
+	configMap = map[string]string{"paramvalidation": "reject"}
+	configMutex.Unlock()
+
+	if err := LoadScales(); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadVelocityCurves(); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadParamEnums(); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadParamDefs(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals := NewParamValues()
+	for _, name := range paramDefNames() {
+		def := lookupParamDef(name)
+		_, err := vals.realSetParamValueWithString(name, def.Init, nil, true)
+		if err != nil {
+			t.Errorf("%s: init value %q is invalid: %s", name, def.Init, err)
+		}
+	}
+}
+
+var errTestInvalid = errors.New("value is not valid")
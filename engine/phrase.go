@@ -55,6 +55,8 @@ type Note struct {
 	Sound    string
 	bytes    []byte
 	next     *Note
+
+	channelOffset int // added to the channel of the Sound, e.g. for per-note pitch bend
 }
 
 // Data1 xxx
@@ -137,6 +139,45 @@ func NewPitchBend(data1 uint8, data2 uint8, sound string) *Note {
 	return &Note{TypeOf: PITCHBEND, Pitch: data1, Velocity: data2, Sound: sound}
 }
 
+// NewBytes creates a new NOTEBYTES, i.e. an arbitrary MIDI message.
+// If the status byte is a channel message, the channel
+// is replaced by the channel of the sound when it's sent.
+func NewBytes(bytes []byte, sound string) *Note {
+	return &Note{TypeOf: NOTEBYTES, bytes: bytes, Sound: sound}
+}
+
+// Bytes returns the MIDI message of a NOTEBYTES
+func (n *Note) Bytes() []byte {
+	return n.bytes
+}
+
+// MIDIMessageLength returns the length of a MIDI message
+// with the given status byte, including the status byte.
+// It returns 0 for SysEx (whose length is variable),
+// and -1 if the status byte isn't valid.
+func MIDIMessageLength(status byte) int {
+	switch status & 0xf0 {
+	case 0x80, 0x90, 0xa0, 0xb0, 0xe0:
+		return 3
+	case 0xc0, 0xd0:
+		return 2
+	case 0xf0:
+		switch status {
+		case 0xf0:
+			return 0
+		case 0xf1, 0xf3:
+			return 2
+		case 0xf2:
+			return 3
+		case 0xf4, 0xf5, 0xfd:
+			return -1 // undefined
+		default:
+			return 1
+		}
+	}
+	return -1
+}
+
 // EndOf returns the ending time of a note
 func (n *Note) EndOf() Clicks {
 	if n.TypeOf == NOTE {
@@ -230,6 +271,8 @@ func (n *Note) Copy() *Note {
 		Sound:    n.Sound,
 		bytes:    n.bytes,
 		next:     nil,
+
+		channelOffset: n.channelOffset,
 	}
 	return newn
 }
@@ -310,6 +353,10 @@ func (p *Phrase) ToString() string {
 // Note that it includes the surrounding quotes that make it look like a Phrase
 func (n *Note) ToString() string {
 
+	// There's no way to write a NOTEBYTES in a Phrase string
+	if n.TypeOf == NOTEBYTES {
+		return "''"
+	}
 	pitch := n.ReadablePitch()
 	if pitch == "" {
 		log.Printf("Note.ToString unable to handle n.Typeof=%d\n", n.TypeOf)
@@ -357,6 +404,12 @@ func (p *Phrase) ToString() string {
 
 	for n := p.firstnote; n != nil; {
 
+		// There's no way to write a NOTEBYTES in a Phrase string, so they're left out
+		if n.TypeOf == NOTEBYTES {
+			n = n.next
+			continue
+		}
+
 		includeTime := true
 		if !first {
 			// Separator is a space if it starts at the same time as the last one, otherwise comma
@@ -4,9 +4,12 @@ package engine
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/vizicist/portmidi"
 )
@@ -23,6 +26,14 @@ type MIDIIO struct {
 	inputDeviceID      map[string]portmidi.DeviceID
 	inputDeviceInfo    map[string]*portmidi.DeviceInfo
 	inputDeviceStream  map[string]*portmidi.Stream
+	// notes currently sounding on each synth
+	notes *noteTracker
+	// Output is scheduled latency milliseconds ahead, plus a per-port offset.
+	// lag is how late the click currently being processed is.
+	timingMutex sync.Mutex
+	latency     int64
+	offsets     map[string]int64 // MIDI device name is the key
+	lag         int64
 }
 
 type midiInput struct {
@@ -55,6 +66,22 @@ func InitMIDI() {
 		inputDeviceID:      make(map[string]portmidi.DeviceID),
 		inputDeviceInfo:    make(map[string]*portmidi.DeviceInfo),
 		inputDeviceStream:  make(map[string]*portmidi.Stream),
+		notes:              newNoteTracker(),
+		offsets:            make(map[string]int64),
+	}
+
+	latency := ConfigValue("midilatency")
+	if latency != "" {
+		ms, err := strconv.Atoi(latency)
+		if err != nil || ms < 0 {
+			log.Printf("InitMIDI: bad midilatency value (%s), using 0\n", latency)
+		} else {
+			m.latency = int64(ms)
+		}
+	}
+	err := m.loadOffsets(ConfigValue("midioffsets"))
+	if err != nil {
+		log.Printf("InitMIDI: err=%s\n", err)
 	}
 
 	// util.InitScales()
@@ -133,13 +160,82 @@ func (m *MIDIIO) SendANO(synth string) {
 	}
 	status := 0xb0 | (s.channel - 1)
 	e := portmidi.Event{
-		Timestamp: portmidi.Time(),
+		Timestamp: m.timestamp(s),
 		Status:    int64(status),
 		Data1:     int64(0x7b),
 		Data2:     int64(0x00),
 	}
 	// log.Printf("Sending ANO portmidi.Event = %s\n", e)
 	SendEvent(s, []portmidi.Event{e})
+	m.notes.clear(synth)
+
+	// Notes sent on other channels (e.g. with per-note pitch bend) get NOTEOFFs
+	prefix := synth + "+"
+	for _, key := range m.notes.synths() {
+		if strings.HasPrefix(key, prefix) {
+			m.sendNoteOffs(key)
+		}
+	}
+}
+
+// ledgerKey is the key of a Note in the ledger of sounding notes,
+// which is the synth name plus the channel offset, if any
+func ledgerKey(n *Note) string {
+	if n.channelOffset == 0 {
+		return n.Sound
+	}
+	return fmt.Sprintf("%s+%d", n.Sound, n.channelOffset)
+}
+
+// channelOf returns the channel (0-15) of output to a synth
+func channelOf(s *synthOutput, offset int) int {
+	return (s.channel - 1 + offset) % 16
+}
+
+// sendNoteOffs sends NOTEOFFs for all the notes in the ledger with the given key
+func (m *MIDIIO) sendNoteOffs(key string) {
+	synth := key
+	offset := 0
+	if plus := strings.LastIndex(key, "+"); plus > 0 {
+		if o, err := strconv.Atoi(key[plus+1:]); err == nil {
+			synth = key[:plus]
+			offset = o
+		}
+	}
+	s := m.getOutput(synth)
+	pitches := m.notes.clear(key)
+	if s == nil || len(pitches) == 0 {
+		return
+	}
+	events := make([]portmidi.Event, 0, len(pitches))
+	for _, pitch := range pitches {
+		events = append(events, portmidi.Event{
+			Timestamp: m.timestamp(s),
+			Status:    int64(0x80 | channelOf(s, offset)),
+			Data1:     int64(pitch),
+			Data2:     int64(0x00),
+		})
+	}
+	if DebugUtil.MIDI {
+		log.Printf("MIDIIO.sendNoteOffs: synth=%s offset=%d pitches=%v\n", synth, offset, pitches)
+	}
+	SendEvent(s, events)
+}
+
+// Panic sends NOTEOFFs for every note that is currently sounding,
+// followed by all-notes-off on every synth.
+func (m *MIDIIO) Panic() {
+	for _, key := range m.notes.synths() {
+		m.sendNoteOffs(key)
+	}
+	for synth := range m.synthOutputs {
+		m.SendANO(synth)
+	}
+}
+
+// SoundingNotes returns the pitches currently sounding on each synth
+func (m *MIDIIO) SoundingNotes() map[string][]int {
+	return m.notes.soundingNotes()
 }
 
 // SendNote sends MIDI output for a Note
@@ -150,21 +246,38 @@ func (m *MIDIIO) SendNote(n *Note) {
 		return
 	}
 
+	if n.TypeOf == NOTEBYTES {
+		m.sendBytes(s, n)
+		return
+	}
+
 	e := portmidi.Event{
-		Timestamp: portmidi.Time(),
-		Status:    int64(s.channel - 1), // pre-populate with the channel
+		Timestamp: m.timestamp(s),
+		Status:    int64(channelOf(s, n.channelOffset)), // pre-populate with the channel
 		Data1:     int64(n.Pitch),
 		Data2:     int64(n.Velocity),
 	}
+	key := ledgerKey(n)
 	switch n.TypeOf {
 	case NOTEON:
 		if n.Velocity == 0 {
 			// log.Printf("MIDIIO.SendNote: NOTEON with velocity==0 is a NOTEOFF\n")
+			if !m.notes.noteOff(key, n.Pitch) {
+				return
+			}
 			e.Status |= 0x80
 		} else {
+			m.notes.noteOn(key, n.Pitch)
 			e.Status |= 0x90
 		}
 	case NOTEOFF:
+		// Only send the NOTEOFF if it balances the last NOTEON of this pitch
+		if !m.notes.noteOff(key, n.Pitch) {
+			if DebugUtil.MIDI {
+				log.Printf("MIDIIO.SendNote: ignoring NOTEOFF, synth=%s pitch=%d is still held or not sounding\n", n.Sound, n.Pitch)
+			}
+			return
+		}
 		e.Status |= 0x80
 	case CONTROLLER:
 		e.Status |= 0xB0
@@ -183,6 +296,149 @@ func (m *MIDIIO) SendNote(n *Note) {
 	SendEvent(s, []portmidi.Event{e})
 }
 
+// sendBytes sends the MIDI message of a NOTEBYTES.
+// SysEx messages are sent as-is, and channel messages
+// have their channel replaced by the channel of the synth.
+func (m *MIDIIO) sendBytes(s *synthOutput, n *Note) {
+
+	bytes := n.bytes
+	if len(bytes) == 0 {
+		log.Printf("MIDIIO.sendBytes: no bytes in NOTEBYTES for %s\n", n.Sound)
+		return
+	}
+	status := bytes[0]
+
+	if status == 0xf0 {
+		if DebugUtil.MIDI {
+			log.Printf("MIDIIO.sendBytes: synth=%s sysex len=%d\n", n.Sound, len(bytes))
+		}
+		if s.stream == nil {
+			log.Printf("MIDIIO.sendBytes: stream is nil?  port=%s\n", s.port)
+			return
+		}
+		if err := s.stream.WriteSysExBytes(m.timestamp(s), bytes); err != nil {
+			log.Printf("MIDIIO.sendBytes: WriteSysExBytes err=%s\n", err)
+		}
+		return
+	}
+
+	nbytes := MIDIMessageLength(status)
+	if nbytes <= 0 || len(bytes) < nbytes {
+		log.Printf("MIDIIO.sendBytes: invalid MIDI message %x\n", bytes)
+		return
+	}
+
+	var data1, data2 byte
+	if nbytes > 1 {
+		data1 = bytes[1]
+	}
+	if nbytes > 2 {
+		data2 = bytes[2]
+	}
+
+	// NOTEONs and NOTEOFFs go through SendNote so they're tracked
+	switch status & 0xf0 {
+	case 0x90:
+		m.SendNote(&Note{TypeOf: NOTEON, Pitch: data1, Velocity: data2, Sound: n.Sound, channelOffset: n.channelOffset})
+		return
+	case 0x80:
+		m.SendNote(&Note{TypeOf: NOTEOFF, Pitch: data1, Velocity: data2, Sound: n.Sound, channelOffset: n.channelOffset})
+		return
+	}
+
+	if status < 0xf0 {
+		status = (status & 0xf0) | byte(channelOf(s, n.channelOffset))
+	}
+	e := portmidi.Event{
+		Timestamp: m.timestamp(s),
+		Status:    int64(status),
+		Data1:     int64(data1),
+		Data2:     int64(data2),
+	}
+	SendEvent(s, []portmidi.Event{e})
+}
+
+// timestamp returns the time at which output to a synth should happen.
+// When midilatency is 0, portmidi ignores timestamps and output is immediate.
+func (m *MIDIIO) timestamp(s *synthOutput) portmidi.Timestamp {
+	now := portmidi.Time()
+	m.timingMutex.Lock()
+	defer m.timingMutex.Unlock()
+	if m.latency == 0 {
+		return now
+	}
+	// Output for a click that's being processed late is pulled
+	// back to when it should have happened, so the lag doesn't
+	// turn into jitter.  The stream adds the latency to this.
+	return now + portmidi.Timestamp(m.offsets[s.port]-m.lag)
+}
+
+// setOutputLag is called while clicks are being processed,
+// with the number of milliseconds that the click is late.
+func (m *MIDIIO) setOutputLag(lag int) {
+	m.timingMutex.Lock()
+	defer m.timingMutex.Unlock()
+	if lag < 0 {
+		lag = 0
+	} else if int64(lag) > m.latency {
+		lag = int(m.latency)
+	}
+	m.lag = int64(lag)
+}
+
+// loadOffsets parses the midioffsets value in settings.json,
+// which looks like "loopMIDI Port 1:-20;Microsoft GS Wavetable Synth:15"
+// i.e. a semicolon-separated list of port:milliseconds
+func (m *MIDIIO) loadOffsets(s string) error {
+	for _, ps := range strings.Split(s, ";") {
+		ps = strings.TrimSpace(ps)
+		if ps == "" {
+			continue
+		}
+		colon := strings.LastIndex(ps, ":")
+		if colon < 0 {
+			return fmt.Errorf("loadOffsets: expecting port:milliseconds - got %s", ps)
+		}
+		ms, err := strconv.Atoi(strings.TrimSpace(ps[colon+1:]))
+		if err != nil {
+			return fmt.Errorf("loadOffsets: bad milliseconds value in %s", ps)
+		}
+		err = m.SetOffset(strings.TrimSpace(ps[:colon]), ms)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetOffset sets the offset (in milliseconds, relative to midilatency)
+// of output to a MIDI port.  Negative offsets make output earlier,
+// which is only possible if midilatency is at least that large.
+// Output is immediate when midilatency is 0, so offsets need a midilatency.
+func (m *MIDIIO) SetOffset(port string, ms int) error {
+	m.timingMutex.Lock()
+	defer m.timingMutex.Unlock()
+	if m.latency == 0 && ms != 0 {
+		return fmt.Errorf("SetOffset: offset %d for port %s needs midilatency to be set", ms, port)
+	}
+	if int64(-ms) > m.latency {
+		return fmt.Errorf("SetOffset: offset %d for port %s is larger than midilatency=%d", ms, port, m.latency)
+	}
+	m.offsets[port] = int64(ms)
+	return nil
+}
+
+// Offsets returns the per-port output offsets, in milliseconds
+func (m *MIDIIO) Offsets() map[string]int {
+	m.timingMutex.Lock()
+	defer m.timingMutex.Unlock()
+	offsets := make(map[string]int)
+	for port, ms := range m.offsets {
+		offsets[port] = int(ms)
+	}
+	return offsets
+}
+
 /*
 // Send writes to a MIDI output
 func Send(out *synthOutput, b1 int64, b2 int64, b3 int64) {
@@ -214,7 +470,12 @@ func (m *MIDIIO) getOutputStream(name string) (devid portmidi.DeviceID, stream *
 	var err error
 	stream, present = m.outputDeviceStream[name]
 	if !present {
-		m.outputDeviceStream[name], err = portmidi.NewOutputStream(devid, 1, 0)
+		// Scheduled output needs room to buffer the events that haven't gone out yet
+		bufferSize := int64(1)
+		if m.latency > 0 {
+			bufferSize = 1024
+		}
+		m.outputDeviceStream[name], err = portmidi.NewOutputStream(devid, bufferSize, m.latency)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -280,7 +541,7 @@ func (m *MIDIIO) loadInputs(dev string) {
 	for _, nm := range words {
 		devid, stream := m.getInputStream(nm)
 		if stream != nil {
-			m.midiInputs[nm] = &midiInput{deviceID: devid, stream: stream}
+			m.midiInputs[nm] = &midiInput{name: nm, deviceID: devid, stream: stream}
 		} else {
 			log.Printf("MIDIIO.loadInputs: Unable to open %s\n", nm)
 		}
@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// presetCategories are the categories of parameters whose presets
+// the engine can load and save, and the parameter prefixes they contain
+var presetCategories = map[string][]string{
+	"snap":    {"sound", "visual", "effect", "misc"},
+	"sound":   {"sound"},
+	"visual":  {"visual"},
+	"effect":  {"effect"},
+	"sliders": {"sliders"},
+}
+
+// PresetFile is the contents of a preset file
+type PresetFile struct {
+	Params map[string]string `json:"params"`
+	// Snap presets also save the modulators routed to the region
+	Modulation *ModulationPreset `json:"modulation,omitempty"`
+}
+
+// PresetReport is the result of the load_preset and save_preset APIs
+type PresetReport struct {
+	Region   string            `json:"region"`
+	Category string            `json:"category"`
+	Name     string            `json:"name"`
+	Path     string            `json:"path"`
+	Params   int               `json:"params"`
+	Errors   map[string]string `json:"errors,omitempty"`   // parameter name is the key
+	Adjusted map[string]string `json:"adjusted,omitempty"` // values that weren't valid but were set, see paramvalidation
+}
+
+// PresetsPath returns the directories of the presetspath setting,
+// with %LOCALAPPDATA% and %MONTAGE% expanded.  As in the GUI,
+// if MONTAGE_SOURCE is set, its default/presets directory comes first,
+// so that new and edited presets get saved there.
+func PresetsPath() []string {
+	p := ConfigValue("presetspath")
+	if p == "" {
+		p = "%LOCALAPPDATA%\\Montage\\presets;%MONTAGE%\\presets"
+	}
+	p = strings.Replace(p, "%LOCALAPPDATA%", os.Getenv("LOCALAPPDATA"), -1)
+	p = strings.Replace(p, "%MONTAGE%", os.Getenv("MONTAGE"), -1)
+	var dirs []string
+	if ps := os.Getenv("MONTAGE_SOURCE"); ps != "" {
+		dirs = append(dirs, filepath.Join(ps, "default", "presets"))
+	}
+	for _, dir := range strings.Split(p, ";") {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// PresetFilePath returns the path of a preset file in a category,
+// from the first directory in the presetspath that has it
+func PresetFilePath(category string, nm string) string {
+	dirs := PresetsPath()
+	for _, dir := range dirs {
+		path := filepath.Join(dir, category, nm+".json")
+		if fileExists(path) {
+			return path
+		}
+	}
+	return LocalPresetFilePath(category, nm)
+}
+
+// LocalPresetFilePath returns the path where a preset gets saved,
+// which is always in the first directory of the presetspath
+func LocalPresetFilePath(category string, nm string) string {
+	dirs := PresetsPath()
+	if len(dirs) == 0 {
+		return filepath.Join(LocalMontageDir(), "presets", category, nm+".json")
+	}
+	return filepath.Join(dirs[0], category, nm+".json")
+}
+
+// presetParamName returns the full name of a parameter in a preset file,
+// e.g. "sizeinitial" in a snap preset is "visual.sizeinitial"
+func presetParamName(category string, name string) (string, error) {
+	for _, prefix := range presetCategories[category] {
+		fullname := prefix + "." + name
+		def, err := NewParamValues().paramDefOf(fullname)
+		if err == nil && def.typedParamDef != nil {
+			return fullname, nil
+		}
+	}
+	return "", fmt.Errorf("unknown parameter %s in %s preset", name, category)
+}
+
+// presetParamNames returns the full names of all the parameters in a category
+func presetParamNames(category string) []string {
+	var names []string
+	for _, prefix := range presetCategories[category] {
+		names = append(names, ParamNames(prefix+".")...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// presetArgs returns the category and name args of the preset APIs
+func presetArgs(api string, args map[string]string) (category string, name string, err error) {
+	category, err = NeedStringArg("category", api, args)
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := presetCategories[category]; !ok {
+		return "", "", fmt.Errorf("api=%s unknown preset category %s", api, category)
+	}
+	name, err = NeedStringArg("name", api, args)
+	if err != nil {
+		return "", "", err
+	}
+	return category, name, nil
+}
+
+// ReadPreset reads a preset file, and returns its values keyed
+// by their full parameter names.  The names in the file that aren't
+// known parameters are returned in errs.
+func ReadPreset(category string, name string) (path string, preset *PresetFile, values map[string]string, errs map[string]string, err error) {
+	path = PresetFilePath(category, name)
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return path, nil, nil, nil, fmt.Errorf("ReadPreset: unable to read path=%s", path)
+	}
+	preset = &PresetFile{}
+	err = json.Unmarshal(bytes, preset)
+	if err != nil {
+		return path, nil, nil, nil, fmt.Errorf("ReadPreset: unable to Unmarshal path=%s, err=%s", path, err)
+	}
+	values = make(map[string]string)
+	errs = make(map[string]string)
+	for nm, value := range preset.Params {
+		fullname, err := presetParamName(category, nm)
+		if err != nil {
+			errs[nm] = err.Error()
+			continue
+		}
+		values[fullname] = value
+	}
+	return path, preset, values, errs, nil
+}
+
+// setParamValues sets many parameters at once (see setParams), directly,
+// so any ramps of them are stopped.  The values that aren't valid
+// are removed from values, and their errors are returned, along with
+// the warnings for the values that were adjusted.
+func (r *Reactor) setParamValues(values map[string]string) (warnings map[string]string, errs map[string]error) {
+	for nm := range values {
+		r.cancelRamp(nm)
+	}
+	warnings, errs = r.setParams(values)
+	for nm := range errs {
+		delete(values, nm)
+	}
+	return warnings, errs
+}
+
+// loadPreset is the load_preset API.  All the valid values in the preset
+// are set at once, and the ones that aren't valid or were adjusted are in the report.
+func (r *Reactor) loadPreset(api string, args map[string]string) (string, error) {
+	category, name, err := presetArgs(api, args)
+	if err != nil {
+		return "", err
+	}
+	path, preset, values, errs, err := ReadPreset(category, name)
+	if err != nil {
+		return "", err
+	}
+	report := &PresetReport{
+		Region:   r.padName,
+		Category: category,
+		Name:     name,
+		Path:     path,
+		Errors:   errs,
+	}
+	warnings, invalid := r.setParamValues(values)
+	for nm, err := range invalid {
+		report.Errors[nm] = err.Error()
+	}
+	if len(warnings) > 0 {
+		report.Adjusted = warnings
+	}
+	report.Params = len(values)
+
+	if preset.Modulation != nil {
+		err = TheRouter().modulation.setRegionPreset(r.padName, preset.Modulation)
+		if err != nil {
+			report.Errors["modulation"] = err.Error()
+		}
+	}
+	if len(report.Errors) > 0 {
+		log.Printf("Reactor.loadPreset: region=%s path=%s has %d invalid values\n", r.padName, path, len(report.Errors))
+	}
+	return presetReportJSON(report)
+}
+
+// savePreset is the save_preset API
+func (r *Reactor) savePreset(api string, args map[string]string) (string, error) {
+	category, name, err := presetArgs(api, args)
+	if err != nil {
+		return "", err
+	}
+	preset := PresetFile{Params: make(map[string]string)}
+	for _, fullname := range presetParamNames(category) {
+		value, err := r.params.paramValueString(fullname)
+		if err != nil {
+			return "", fmt.Errorf("Reactor.savePreset: %s", err)
+		}
+		nm := fullname[strings.Index(fullname, ".")+1:]
+		preset.Params[nm] = value
+	}
+	if category == "snap" {
+		preset.Modulation = TheRouter().modulation.regionPreset(r.padName)
+	}
+
+	path := LocalPresetFilePath(category, name)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", fmt.Errorf("Reactor.savePreset: unable to create dir for path=%s, err=%s", path, err)
+	}
+	bytes, err := json.MarshalIndent(preset, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("Reactor.savePreset: err=%s", err)
+	}
+	err = ioutil.WriteFile(path, bytes, 0644)
+	if err != nil {
+		return "", fmt.Errorf("Reactor.savePreset: unable to write path=%s, err=%s", path, err)
+	}
+	log.Printf("Reactor.savePreset: region=%s saved path=%s\n", r.padName, path)
+	return presetReportJSON(&PresetReport{
+		Region:   r.padName,
+		Category: category,
+		Name:     name,
+		Path:     path,
+		Params:   len(preset.Params),
+	})
+}
+
+func presetReportJSON(report *PresetReport) (string, error) {
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		return "", fmt.Errorf("presetReportJSON: err=%s", err)
+	}
+	return string(bytes), nil
+}
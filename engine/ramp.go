@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramRamp is a numeric parameter gliding to a target value
+type paramRamp struct {
+	name      string // e.g. "visual.sizeinitial"
+	from      float32
+	to        float32
+	isInt     bool
+	start     Clicks
+	length    Clicks
+	shape     rampShape
+	lastValue string
+}
+
+// rampShape maps the fraction of a ramp's length that has gone by (0.0-1.0)
+// to the fraction of the way from the start value to the target (0.0-1.0)
+type rampShape func(float32) float32
+
+// rampShapes are the values of the curve arg of the ramp APIs
+var rampShapes = map[string]rampShape{
+	"linear":      func(f float32) float32 { return f },
+	"exponential": func(f float32) float32 { return f * f },
+	"logarithmic": func(f float32) float32 { return 1.0 - (1.0-f)*(1.0-f) },
+	"scurve":      func(f float32) float32 { return f * f * (3.0 - 2.0*f) },
+}
+
+// rampArgs are the args of the ramp APIs that aren't parameter names
+var rampArgs = map[string]bool{
+	"duration": true,
+	"beats":    true,
+	"curve":    true,
+	"region":   true,
+}
+
+// rampLength returns the length of a ramp, from the duration (in seconds)
+// or beats args, and the shape given by the curve arg
+func rampLength(api string, args map[string]string) (Clicks, rampShape, error) {
+	var length Clicks
+	if _, ok := args["beats"]; ok {
+		beats, err := NeedFloatArg("beats", api, args)
+		if err != nil {
+			return 0, nil, err
+		}
+		length = Clicks(beats*float32(oneBeat) + 0.5)
+	} else {
+		secs, err := NeedFloatArg("duration", api, args)
+		if err != nil {
+			return 0, nil, err
+		}
+		length = Clicks(secs*float32(clicksPerSecond) + 0.5)
+	}
+	if length < 1 {
+		length = 1
+	}
+	curve := OptionalStringArg("curve", args, "linear")
+	shape, ok := rampShapes[curve]
+	if !ok {
+		return 0, nil, fmt.Errorf("api=%s unknown curve %s", api, curve)
+	}
+	return length, shape, nil
+}
+
+// startRamp starts (or replaces) the ramp of a parameter
+func (r *Reactor) startRamp(name string, target string, length Clicks, shape rampShape) error {
+	from, isInt, err := r.params.paramNumericValue(name)
+	if err != nil {
+		return err
+	}
+	to, err := ParseFloat32(target, name)
+	if err != nil {
+		return err
+	}
+	ramp := &paramRamp{
+		name:   name,
+		from:   from,
+		to:     to,
+		isInt:  isInt,
+		start:  advanceClick, // the clock of advanceRamps
+		length: length,
+		shape:  shape,
+	}
+	r.rampsMutex.Lock()
+	r.ramps[name] = ramp
+	r.rampsMutex.Unlock()
+	return nil
+}
+
+// rampParam is the ramp_param API
+func (r *Reactor) rampParam(api string, args map[string]string) error {
+	name, err := NeedStringArg("param", api, args)
+	if err != nil {
+		return err
+	}
+	value, err := NeedStringArg("value", api, args)
+	if err != nil {
+		return err
+	}
+	length, shape, err := rampLength(api, args)
+	if err != nil {
+		return err
+	}
+	return r.startRamp(name, value, length, shape)
+}
+
+// rampParams is the global ramp_params API.  All the args other than
+// duration/beats/curve/region are parameter names and target values,
+// and they're ramped in all regions, or the one given by region.
+func (r *Router) rampParams(api string, args map[string]string) error {
+	length, shape, err := rampLength(api, args)
+	if err != nil {
+		return err
+	}
+	region := OptionalStringArg("region", args, "")
+	var errs []string
+	for rname, reactor := range r.reactors {
+		if region != "" && rname != region {
+			continue
+		}
+		for name, value := range args {
+			if rampArgs[name] {
+				continue
+			}
+			err := reactor.startRamp(name, value, length, shape)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("region %s: %s", rname, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("Router.rampParams: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// cancelRamp stops the ramp of a parameter, e.g. when it's set directly
+func (r *Reactor) cancelRamp(name string) {
+	r.rampsMutex.Lock()
+	delete(r.ramps, name)
+	r.rampsMutex.Unlock()
+}
+
+// stopRamps stops all the ramps of a region
+func (r *Reactor) stopRamps() {
+	r.rampsMutex.Lock()
+	r.ramps = make(map[string]*paramRamp)
+	r.rampsMutex.Unlock()
+}
+
+// advanceRamps is called on every click, and sets the
+// current value of every parameter that's ramping
+func (r *Reactor) advanceRamps(clk Clicks) {
+	values := make(map[string]string)
+	r.rampsMutex.Lock()
+	for name, ramp := range r.ramps {
+		frac := float32(clk-ramp.start) / float32(ramp.length)
+		done := frac >= 1.0
+		v := ramp.from + (ramp.to-ramp.from)*ramp.shape(clamp01(frac))
+		if done {
+			v = ramp.to
+		}
+		var value string
+		if ramp.isInt {
+			value = strconv.Itoa(int(v + 0.5))
+			if v < 0 {
+				value = strconv.Itoa(int(v - 0.5))
+			}
+		} else {
+			value = fmt.Sprintf("%f", v)
+		}
+		if value != ramp.lastValue {
+			ramp.lastValue = value
+			values[name] = value
+		}
+		if done {
+			delete(r.ramps, name)
+		}
+	}
+	r.rampsMutex.Unlock()
+
+	if len(values) == 0 {
+		return
+	}
+	// rampsMutex isn't held here, since setting parameters
+	// can stop ramps (e.g. in the regions linked to this one)
+	_, errs := r.setParams(values)
+	for name, err := range errs {
+		log.Printf("Reactor.advanceRamps: region=%s err=%s, ramp stopped\n", r.padName, err)
+		r.cancelRamp(name)
+	}
+}
+
+// applyParam sets a parameter (see setParams) without stopping its ramp
+func (r *Reactor) applyParam(name string, value string) error {
+	_, errs := r.setParams(map[string]string{name: value})
+	return errs[name]
+}
+
+// sendParam sends a parameter value where it needs to go
+func (r *Reactor) sendParam(name string, value string) {
+	switch {
+	case strings.HasPrefix(name, "effect."):
+		r.sendEffectParam(strings.TrimPrefix(name, "effect."), value)
+	case strings.HasPrefix(name, "visual."):
+		r.sendVisualParam(strings.TrimPrefix(name, "visual."), value)
+	}
+}
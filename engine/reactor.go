@@ -1,9 +1,11 @@
 package engine
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,13 +32,17 @@ var clicksPerSecond int
 var currentClick Clicks
 var oneBeat Clicks
 
+// advanceClick is the click currently being processed by Router.advanceClickTo
+var advanceClick Clicks
+
 // TempoFactor xxx
 var TempoFactor = float64(1.0)
 
 // ActiveNote is a currently active MIDI note
 type ActiveNote struct {
-	id     int
-	noteOn *Note
+	id         int
+	noteOn     *Note
+	chordNotes []*Note // the other notes of the chord, when sound.chord is used
 }
 
 // Reactor is an entity that that reacts to things (cursor events, apis) and generates output (midi, graphics)
@@ -62,6 +68,7 @@ type Reactor struct {
 	paramsMutex               sync.RWMutex
 	activeNotes               map[string]*ActiveNote
 	activeNotesMutex          sync.RWMutex
+	oneShotPitch              map[string]uint8 // last pitch played by each gesture, when notes have a duration
 	activeGestures            map[string]*ActiveStepGesture
 	activeGesturesMutex       sync.RWMutex
 	permInstanceIDMutex       sync.RWMutex
@@ -74,6 +81,14 @@ type Reactor struct {
 	deviceGesturesMutex       sync.RWMutex
 
 	activePhrasesManager *ActivePhrasesManager
+	arpeggiator          *Arpeggiator
+	tuner                *tuner
+	drummer              *drummer
+	voices               *voiceAllocator
+	ramps                map[string]*paramRamp
+	rampsMutex           sync.Mutex
+	morph                *presetMorph
+	sliders              *sliders
 
 	// Things moved over from Router
 	MIDINumDown      int
@@ -84,6 +99,7 @@ type Reactor struct {
 	TransposePitch   int
 	midiInputMutex   sync.RWMutex
 	externalScale    *Scale
+	lastScaleError   string
 }
 
 // NewReactor makes a new Reactor
@@ -98,6 +114,7 @@ func NewReactor(pad string, resolumeLayer int, freeframeClient *osc.Client, reso
 		// params:                         make(map[string]interface{}),
 		params:                    NewParamValues(),
 		activeNotes:               make(map[string]*ActiveNote),
+		oneShotPitch:              make(map[string]uint8),
 		activeGestures:            make(map[string]*ActiveStepGesture),
 		permInstanceIDQuantized:   make(map[string]string),
 		permInstanceIDUnquantized: make(map[string]string),
@@ -108,6 +125,13 @@ func NewReactor(pad string, resolumeLayer int, freeframeClient *osc.Client, reso
 		loop:                      NewLoop(oneBeat * 4),
 		deviceGestures:            make(map[string]*DeviceGesture),
 		activePhrasesManager:      NewActivePhrasesManager(),
+		arpeggiator:               NewArpeggiator(),
+		tuner:                     &tuner{},
+		drummer:                   &drummer{},
+		voices:                    newVoiceAllocator(),
+		ramps:                     make(map[string]*paramRamp),
+		morph:                     &presetMorph{},
+		sliders:                   &sliders{},
 
 		MIDIOctaveShift:  0,
 		MIDIThru:         "thru",
@@ -116,6 +140,8 @@ func NewReactor(pad string, resolumeLayer int, freeframeClient *osc.Client, reso
 		TransposePitch:   0,
 	}
 	r.params.SetDefaultValues()
+	// Notes played by phrases (e.g. ones with a duration) get tuned and counted as voices, too
+	r.activePhrasesManager.sendNote = r.sendNote
 	r.ClearExternalScale()
 	r.SetExternalScale(60%12, true) // Middle C
 
@@ -229,6 +255,7 @@ func (r *Reactor) terminateActiveNotes() {
 		}
 	}
 	r.activeNotesMutex.RUnlock()
+	r.clearArpeggiator()
 }
 
 func (r *Reactor) clearGraphics() {
@@ -404,6 +431,12 @@ func (r *Reactor) HandleMIDIDeviceInput(e portmidi.Event) {
 	if DebugUtil.MIDI {
 		log.Printf("Router.HandleMIDIDeviceInput: MIDIInput event=%+v\n", e)
 	}
+
+	// MIDI that's bound to parameters (or being learned) isn't passed through
+	if TheMIDILearner().HandleMIDIDeviceInput(r, e) {
+		return
+	}
+
 	switch r.MIDIThru {
 	case "":
 		// do nothing
@@ -411,6 +444,8 @@ func (r *Reactor) HandleMIDIDeviceInput(e portmidi.Event) {
 		// do nothing
 	case "setscale":
 		r.handleMIDISetScaleNote(e)
+	case "setchord":
+		r.handleMIDISetChordNote(e)
 	case "thru":
 		r.PassThruMIDI(e, false)
 	case "thruscadjust":
@@ -420,19 +455,55 @@ func (r *Reactor) HandleMIDIDeviceInput(e portmidi.Event) {
 	}
 }
 
+// HandleMIDISysEx passes a SysEx message through to this region's synth
+func (r *Reactor) HandleMIDISysEx(msg []byte) {
+
+	r.midiInputMutex.Lock()
+	defer r.midiInputMutex.Unlock()
+
+	if DebugUtil.MIDI {
+		log.Printf("Router.HandleMIDISysEx: len=%d\n", len(msg))
+	}
+
+	switch r.MIDIThru {
+	case "thru", "thruscadjust":
+		synth := r.params.ParamStringValue("sound.synth", defaultSynth)
+		MIDI.SendNote(NewBytes(msg, synth))
+	}
+}
+
 // getScale xxx
 func (r *Reactor) getScale() *Scale {
-	var scaleName string
-	var scale *Scale
-	if r.useExternalScale {
-		scale = r.externalScale
-	} else {
-		scaleName = r.params.ParamStringValue("misc.scale", "newage")
-		scale = GlobalScale(scaleName)
+	scaleName := r.params.ParamStringValue("misc.scale", "newage")
+	if r.useExternalScale || scaleName == "external" {
+		return r.externalScale
+	}
+	// Tunings that don't have 12 notes per octave use the keys they map
+	if tuning := r.getTuning(); tuning != nil && !tuning.IsTwelveTone() {
+		return tuning.keys
+	}
+	keyName := r.params.ParamStringValue("misc.key", "C")
+	key, err := KeyOf(keyName)
+	if err != nil {
+		r.logScaleError(err)
+	}
+	scale, err := GlobalScale(scaleName, key)
+	if err != nil {
+		r.logScaleError(err)
+		scale = chromaticScale
 	}
 	return scale
 }
 
+// logScaleError logs a problem with the scale parameters,
+// but only once, since getScale is called for every note
+func (r *Reactor) logScaleError(err error) {
+	if err.Error() != r.lastScaleError {
+		r.lastScaleError = err.Error()
+		log.Printf("Reactor.getScale: region=%s err=%s\n", r.padName, err)
+	}
+}
+
 // PassThruMIDI xxx
 func (r *Reactor) PassThruMIDI(e portmidi.Event, scadjust bool) {
 
@@ -452,6 +523,16 @@ func (r *Reactor) PassThruMIDI(e portmidi.Event, scadjust bool) {
 		scale := r.getScale()
 		pitch = scale.ClosestTo(pitch)
 	}
+	// When arpeggiating, held notes go to the arpeggiator rather than the synth
+	if (status == 0x90 || status == 0x80) && r.arpeggiating() {
+		id := fmt.Sprintf("midi%d", data1)
+		if status == 0x90 && data2 > 0 {
+			r.arpeggiator.hold(id, pitch, data2)
+		} else {
+			r.arpeggiator.release(id)
+		}
+		return
+	}
 	switch status {
 	case 0x90:
 		n = NewNoteOn(pitch, data2, synth)
@@ -466,25 +547,54 @@ func (r *Reactor) PassThruMIDI(e portmidi.Event, scadjust bool) {
 	case 0xE0:
 		n = NewPitchBend(data1, data2, synth)
 	default:
-		log.Printf("PassThruMIDI unable to handle status=%02x\n", status)
-		return
+		// Everything else (polyphonic aftertouch, system messages)
+		// is passed through as bytes
+		nbytes := MIDIMessageLength(byte(e.Status))
+		if nbytes <= 0 {
+			log.Printf("PassThruMIDI unable to handle status=%02x\n", e.Status)
+			return
+		}
+		n = NewBytes([]byte{byte(e.Status), data1, data2}[:nbytes], synth)
 	}
 	if n != nil {
 		// log.Printf("PassThruMIDI sending note=%s\n", n)
 		if DebugUtil.MIDI {
 			log.Printf("MIDI.SendNote: n=%+v\n", *n)
 		}
-		MIDI.SendNote(n)
+		r.sendNote(n)
 	}
 }
 
 func (r *Reactor) generateSoundFromGesture(ce GestureStepEvent) {
+	// Gestures trigger the envelope modulators
+	switch ce.Downdragup {
+	case "down":
+		TheRouter().modulation.gestureDown(r.padName)
+	case "up":
+		TheRouter().modulation.gestureUp(r.padName)
+	}
+	r.morphFromGesture(ce)
 	if !TheRouter().generateSound {
 		return
 	}
 	if DebugUtil.GenSound {
 		log.Printf("Reactor.generateSound: pad=%s activeNotes=%d ce=%+v\n", r.padName, len(r.activeNotes), ce)
 	}
+	if r.params.ParamStringValue("misc.logic_sound", "default") == "drumpads" {
+		if ce.Downdragup == "up" {
+			r.endActiveNote(ce.ID)
+		}
+		r.playDrumPad(ce)
+		return
+	}
+	if r.arpeggiating() {
+		r.arpeggiateGesture(ce)
+		return
+	}
+	if duration := r.cursorToDuration(ce); duration > 0 {
+		r.playGestureWithDuration(ce, duration)
+		return
+	}
 	a := r.getActiveNote(ce.ID)
 	switch ce.Downdragup {
 	case "down":
@@ -497,6 +607,7 @@ func (r *Reactor) generateSoundFromGesture(ce GestureStepEvent) {
 			r.sendNoteOff(a)
 		}
 		a.noteOn = r.cursorToNoteOn(ce)
+		a.chordNotes = r.cursorToChordNotes(ce, a.noteOn)
 		// log.Printf("r=%s down Setting currentNoteOn to %v!\n", r.padName, *(a.currentNoteOn))
 		// log.Printf("generateMIDI sending NoteOn for down\n")
 		r.sendNoteOn(a)
@@ -513,6 +624,7 @@ func (r *Reactor) generateSoundFromGesture(ce GestureStepEvent) {
 			r.sendNoteOff(a)
 		}
 		a.noteOn = r.cursorToNoteOn(ce)
+		a.chordNotes = r.cursorToChordNotes(ce, a.noteOn)
 		// log.Printf("r=%s drag Setting currentNoteOn to %v!\n", r.padName, *(a.currentNoteOn))
 		// log.Printf("generateMIDI sending NoteOn\n")
 		r.sendNoteOn(a)
@@ -523,14 +635,6 @@ func (r *Reactor) generateSoundFromGesture(ce GestureStepEvent) {
 		} else {
 			// log.Printf("generateMIDI sending NoteOff for UP\n")
 			r.sendNoteOff(a)
-
-			// HACK! There are hanging notes, seems to occur when sending multiple noteons of
-			// the same pitch to the same synth, but I tried fixing it and failed. So.
-			if DebugUtil.MIDI {
-				log.Printf("MIDI.SendANO: synth=%s\n", a.noteOn.Sound)
-			}
-			MIDI.SendANO(a.noteOn.Sound)
-
 			a.noteOn = nil
 			// log.Printf("r=%s UP Setting currentNoteOn to nil!\n", r.padName)
 		}
@@ -540,6 +644,71 @@ func (r *Reactor) generateSoundFromGesture(ce GestureStepEvent) {
 	}
 }
 
+// arpeggiateGesture sends the notes of a gesture to the arpeggiator
+func (r *Reactor) arpeggiateGesture(ce GestureStepEvent) {
+	switch ce.Downdragup {
+	case "down", "drag":
+		n := r.cursorToNoteOn(ce)
+		r.arpeggiator.hold(ce.ID, n.Pitch, n.Velocity)
+		// The other notes of a chord are held with ids of the form {id}.{n}
+		r.arpeggiator.releaseChord(ce.ID)
+		for i, cn := range r.cursorToChordNotes(ce, n) {
+			r.arpeggiator.hold(fmt.Sprintf("%s.%d", ce.ID, i+1), cn.Pitch, cn.Velocity)
+		}
+	case "up":
+		r.arpeggiator.release(ce.ID)
+		r.arpeggiator.releaseChord(ce.ID)
+		// The gesture may have started before the arpeggiator was turned on
+		r.endActiveNote(ce.ID)
+	}
+}
+
+// playGestureWithDuration plays the notes of a gesture as one-shot notes,
+// whose NOTEOFFs are scheduled by the activePhrasesManager rather than
+// being sent when the gesture ends.
+func (r *Reactor) playGestureWithDuration(ce GestureStepEvent, duration Clicks) {
+	switch ce.Downdragup {
+	case "down", "drag":
+		n := r.cursorToNoteOn(ce)
+		// Drags only play a new note when the pitch changes,
+		// otherwise every drag event would retrigger it
+		r.activeNotesMutex.Lock()
+		lastPitch, ok := r.oneShotPitch[ce.ID]
+		r.oneShotPitch[ce.ID] = n.Pitch
+		r.activeNotesMutex.Unlock()
+		if ce.Downdragup == "drag" && ok && lastPitch == n.Pitch {
+			return
+		}
+		p := NewPhrase()
+		p.InsertNote(NewNote(n.Pitch, n.Velocity, duration, n.Sound))
+		for _, cn := range r.cursorToChordNotes(ce, n) {
+			p.InsertNote(NewNote(cn.Pitch, cn.Velocity, duration, cn.Sound))
+		}
+		r.activePhrasesManager.StartOneShot(p, "")
+		if r.params.ParamStringValue("visual.spritesource", "") == "midi" {
+			r.generateSpriteFromNote(&ActiveNote{noteOn: n})
+		}
+	case "up":
+		// The gesture may have started before the duration mode was changed
+		r.activeNotesMutex.Lock()
+		delete(r.oneShotPitch, ce.ID)
+		r.activeNotesMutex.Unlock()
+		r.endActiveNote(ce.ID)
+	}
+}
+
+// endActiveNote turns off the note (if any) of a gesture
+// that was started before the way it's played was changed
+func (r *Reactor) endActiveNote(id string) {
+	r.activeNotesMutex.Lock()
+	a, ok := r.activeNotes[id]
+	delete(r.activeNotes, id)
+	r.activeNotesMutex.Unlock()
+	if ok && a.noteOn != nil {
+		r.sendNoteOff(a)
+	}
+}
+
 // StartPhrase xxx
 func (r *Reactor) StartPhrase(p *Phrase, cid string) {
 	r.activePhrasesManager.StartPhrase(p, "midiplaycid")
@@ -549,6 +718,8 @@ func (r *Reactor) StartPhrase(p *Phrase, cid string) {
 func (r *Reactor) AdvanceByOneClick() {
 
 	r.activePhrasesManager.AdvanceByOneClick()
+	r.advanceArpeggiator(advanceClick)
+	r.advanceRamps(advanceClick)
 
 	loop := r.loop
 
@@ -831,7 +1002,10 @@ func (r *Reactor) sendNoteOn(a *ActiveNote) {
 	if DebugUtil.MIDI {
 		log.Printf("MIDI.SendNote: a.noteOn=%+v\n", *(a.noteOn))
 	}
-	MIDI.SendNote(a.noteOn)
+	r.sendNote(a.noteOn)
+	for _, n := range a.chordNotes {
+		r.sendNote(n)
+	}
 
 	ss := r.params.ParamStringValue("visual.spritesource", "")
 	if ss == "midi" {
@@ -854,20 +1028,27 @@ func (r *Reactor) sendNoteOff(a *ActiveNote) {
 		if DebugUtil.MIDI {
 			log.Printf("MIDI.SendNote: noteOff=%+v\n", *noteOff)
 		}
-		MIDI.SendNote(noteOff)
+		r.sendNote(noteOff)
 	}
+	for _, cn := range a.chordNotes {
+		r.sendNote(NewNoteOff(cn.Pitch, cn.Velocity, cn.Sound))
+	}
+	a.chordNotes = nil
 }
 
 func (r *Reactor) sendANO() {
 	if !TheRouter().generateSound {
 		return
 	}
+	r.clearArpeggiator()
 	synth := r.params.ParamStringValue("sound.synth", defaultSynth)
 	if synth != "" {
 		if DebugUtil.MIDI {
 			log.Printf("MIDI.SendANO: synth=%s\n", synth)
 		}
 		MIDI.SendANO(synth)
+		r.clearTunedNotes()
+		r.voices.clear()
 	} else {
 		log.Printf("MIDI.SendANO: pad=%s synth is empty?\n", r.padName)
 	}
@@ -906,18 +1087,28 @@ func (r *Reactor) cursorToNoteOn(ce GestureStepEvent) *Note {
 }
 
 func (r *Reactor) cursorToPitch(ce GestureStepEvent) uint8 {
-	pitchmin := r.params.ParamIntValue("sound.pitchmin")
-	pitchmax := r.params.ParamIntValue("sound.pitchmax")
-	dp := pitchmax - pitchmin + 1
-	p1 := int(ce.X * float32(dp))
-	p := uint8(pitchmin + p1%dp)
-	scale := r.getScale()
-	p = scale.ClosestTo(p)
-	pnew := p + uint8(12*r.MIDIOctaveShift)
+	var p uint8
+	if r.params.ParamStringValue("misc.logic_sound", "default") == "midigrid" {
+		// x and y together select the pitch
+		p = r.gridPitch(ce.X, ce.Y)
+	} else {
+		pitchmin := r.params.ParamIntValue("sound.pitchmin")
+		pitchmax := r.params.ParamIntValue("sound.pitchmax")
+		dp := pitchmax - pitchmin + 1
+		p1 := int(ce.X * float32(dp))
+		p = uint8(pitchmin + p1%dp)
+		scale := r.getScale()
+		p = scale.ClosestTo(p)
+	}
+	octave := 12
+	if tuning := r.getTuning(); tuning != nil {
+		octave = tuning.KeysPerPeriod()
+	}
+	pnew := p + uint8(octave*r.MIDIOctaveShift)
 	if pnew < 0 {
-		p = pnew + 12
+		p = pnew + uint8(octave)
 	} else if pnew > 127 {
-		p = pnew - 12
+		p = pnew - uint8(octave)
 	} else {
 		p = uint8(pnew)
 	}
@@ -925,38 +1116,47 @@ func (r *Reactor) cursorToPitch(ce GestureStepEvent) uint8 {
 }
 
 func (r *Reactor) cursorToVelocity(ce GestureStepEvent) uint8 {
-	vol := r.params.ParamStringValue("misc.vol", "fixed")
-	velocitymin := r.params.ParamIntValue("sound.velocitymin")
-	velocitymax := r.params.ParamIntValue("sound.velocitymax")
-	// bogus, when values in json are missing
-	if velocitymin == 0 && velocitymax == 0 {
-		velocitymin = 0
-		velocitymax = 127
-	}
-	if velocitymin > velocitymax {
-		t := velocitymin
-		velocitymin = velocitymax
-		velocitymax = t
-	}
-	v := float32(0.8) // default and fixed value
-	switch vol {
-	case "frets":
-		v = 1.0 - ce.Y
-	case "pressure":
-		v = ce.Z * 4.0
-	case "fixed":
-		// do nothing
-	default:
-		log.Printf("Unrecognized vol value: %s, assuming %f\n", vol, v)
+	v, curved := r.cursorVolValue(ce)
+	curveName := "linear"
+	if curved {
+		curveName = r.params.ParamStringValue("sound.velocitycurve", "linear")
+	}
+	vel, err := r.velocityOf(v, curveName)
+	if err != nil {
+		log.Printf("Reactor.cursorToVelocity: err=%s\n", err)
+		vel, _ = r.velocityOf(v, "linear")
 	}
-	dv := velocitymax - velocitymin + 1
-	p1 := int(v * float32(dv))
-	vel := uint8(velocitymin + p1%dv)
-	return uint8(vel)
+	return vel
 }
 
-func (r *Reactor) cursorToDuration(ce GestureStepEvent) int {
-	return 92
+// cursorToDuration returns the duration of the notes of a gesture,
+// or 0 if they last as long as the gesture is held
+func (r *Reactor) cursorToDuration(ce GestureStepEvent) Clicks {
+	mode := r.params.ParamStringValue("sound.durationmode", "held")
+	durmax := r.params.ParamFloatValue("sound.duration")
+	durmin := r.params.ParamFloatValue("sound.durationmin")
+	var beats float32
+	switch mode {
+	case "held", "":
+		return 0
+	case "fixed":
+		beats = durmax
+	case "y":
+		beats = durmin + clamp01(ce.Y)*(durmax-durmin)
+	case "z":
+		z := ce.Z * r.params.ParamFloatValue("sound.pressurescale")
+		beats = durmin + clamp01(z)*(durmax-durmin)
+	case "staccato":
+		beats = durmin
+	default:
+		log.Printf("Unrecognized durationmode value: %s, assuming held\n", mode)
+		return 0
+	}
+	d := Clicks(beats*float32(oneBeat) + 0.5)
+	if d < 1 {
+		d = 1
+	}
+	return d
 }
 
 func (r *Reactor) cursorToQuant(ce GestureStepEvent) Clicks {
@@ -1001,35 +1201,95 @@ type Param struct {
 	value string
 }
 
-func (r *Reactor) handleSetParam(apiprefix, apisuffix string, args map[string]string) (handled bool, err error) {
+// handleSetParam handles the set_param and set_params APIs.  The result
+// is a paramSetResult, with the values that were adjusted (see paramvalidation).
+func (r *Reactor) handleSetParam(apiprefix, apisuffix string, args map[string]string) (handled bool, result string, err error) {
 
 	// ALL *.set_params and *.set_param APIs
 	// set the params in the Reactor.
 
-	handled = false
-	if apisuffix == "set_params" {
-		for name, value := range args {
-			r.params.SetParamValueWithString(apiprefix+name, value, nil)
-			if apiprefix == "effect." {
-				r.sendEffectParam(name, value)
-			}
-		}
-		handled = true
-	}
-	if apisuffix == "set_param" {
+	var values map[string]string
+	switch apisuffix {
+	case "set_params":
+		values = args
+	case "set_param":
 		name, okname := args["param"]
 		value, okvalue := args["value"]
 		if !okname || !okvalue {
-			err = fmt.Errorf("Reactor.handleSetParam: api=%s%s, missing param or value", apiprefix, apisuffix)
-		} else {
-			r.params.SetParamValueWithString(apiprefix+name, value, nil)
-			if apiprefix == "effect." {
-				r.sendEffectParam(name, value)
-			}
-			handled = true
+			return false, "", fmt.Errorf("Reactor.handleSetParam: api=%s%s, missing param or value", apiprefix, apisuffix)
 		}
+		values = map[string]string{name: value}
+	default:
+		return false, "", nil
 	}
-	return handled, err
+
+	// The valid values are set even when others aren't valid
+	fullvalues := make(map[string]string)
+	for name, value := range values {
+		fullvalues[apiprefix+name] = value
+	}
+	warnings, errs := r.setParamValues(fullvalues)
+	if len(errs) > 0 {
+		var s []string
+		for _, e := range errs {
+			s = append(s, e.Error())
+		}
+		sort.Strings(s)
+		return true, "", fmt.Errorf("Reactor.handleSetParam: %s", strings.Join(s, "; "))
+	}
+	bytes, err := json.Marshal(paramSetResult{Adjusted: warnings})
+	if err != nil {
+		return true, "", fmt.Errorf("Reactor.handleSetParam: err=%s", err)
+	}
+	return true, string(bytes), nil
+}
+
+// setParams is what every way of setting the parameters of a region
+// (APIs, presets, ramps, sliders, the morph) uses.  The values that are stored
+// (which may have been clamped, see paramvalidation) are sent where they
+// need to go, the things that depend on them get updated, and they're set
+// in the regions linked to this one.  The errors of the values that
+// aren't valid are returned, and the valid ones are still set.
+// The warnings are for the values that were adjusted.
+func (r *Reactor) setParams(values map[string]string) (warnings map[string]string, errs map[string]error) {
+	return r.setParamsAndLinks(values, true)
+}
+
+func (r *Reactor) setParamsAndLinks(values map[string]string, propagate bool) (warnings map[string]string, errs map[string]error) {
+	warnings, errs = r.params.SetParamValues(values)
+	stored := make(map[string]string)
+	visuals := make(map[string]string)
+	for nm := range values {
+		if _, bad := errs[nm]; bad {
+			continue
+		}
+		value := exactParamValue(r.params.paramValue(nm))
+		stored[nm] = value
+		switch {
+		case strings.HasPrefix(nm, "effect."):
+			r.sendEffectParam(strings.TrimPrefix(nm, "effect."), value)
+		case strings.HasPrefix(nm, "visual."):
+			visuals[strings.TrimPrefix(nm, "visual.")] = value
+		}
+	}
+	if len(visuals) > 0 {
+		r.sendVisualParams(visuals)
+	}
+	for nm := range stored {
+		r.paramUpdated(nm)
+	}
+	if propagate {
+		TheRouter().propagateLinkedParams(r, stored)
+	}
+	return warnings, errs
+}
+
+// paramUpdated does what the new value of a parameter needs
+func (r *Reactor) paramUpdated(name string) {
+	if name == "misc.morph" {
+		r.applyMorph()
+	}
+	r.sliderParamChanged(name)
 }
 
 // ExecuteAPI xxx
@@ -1045,13 +1305,15 @@ func (r *Reactor) ExecuteAPI(api string, args map[string]string, rawargs string)
 		apisuffix = api[dot+1:]
 	}
 
-	handled, err := r.handleSetParam(apiprefix, apisuffix, args)
+	var handled bool
+	handled, result, err = r.handleSetParam(apiprefix, apisuffix, args)
 	if err != nil {
 		return "", err
 	}
 
-	// ALL visual.* APIs get forwarded to the FreeFrame plugin inside Resolume
-	if apiprefix == "visual." {
+	// ALL other visual.* APIs get forwarded to the FreeFrame plugin inside Resolume
+	// (handleSetParam sends the values of set_param and set_params)
+	if apiprefix == "visual." && !handled {
 		msg := osc.NewMessage("/api")
 		msg.Append(apisuffix)
 		msg.Append(rawargs)
@@ -1121,12 +1383,75 @@ func (r *Reactor) ExecuteAPI(api string, args map[string]string, rawargs string)
 			r.MIDIQuantized = v
 		}
 
+	case "midi_send":
+		err = r.midiSend(api, args)
+
+	case "velocity_preview":
+		result, err = r.velocityPreview(api, args)
+
+	case "layout":
+		result, err = r.layoutJSON()
+
+	case "voice_status":
+		result, err = r.voiceStatus()
+
+	case "voice_reset":
+		r.voiceReset()
+
+	case "ramp_param":
+		err = r.rampParam(api, args)
+
+	case "ramp_stop":
+		r.stopRamps()
+
+	case "load_preset":
+		result, err = r.loadPreset(api, args)
+
+	case "save_preset":
+		result, err = r.savePreset(api, args)
+
+	case "morph_presets":
+		err = r.morphPresets(api, args)
+
+	case "morph":
+		err = r.setMorph(api, args)
+
+	case "morph_clear":
+		r.morphClear()
+
+	case "slider":
+		err = r.setSlider(api, args)
+
+	case "get_param":
+		result, err = r.getParam(api, args)
+
+	case "get_params":
+		result, err = r.getParams(api, args)
+
+	case "clear_override":
+		err = r.clearOverrides(api, args)
+
 	case "set_transpose":
 		v, err := NeedIntArg("value", api, args)
 		if err == nil {
 			r.TransposePitch = v
 		}
 
+	case "midilearn":
+		err = r.midiLearn(api, args)
+
+	case "midilearn_cancel":
+		TheMIDILearner().Cancel()
+
+	case "midiunlearn":
+		target := OptionalStringArg("param", args, "")
+		if target == "" {
+			target, err = NeedStringArg("api", api, args)
+		}
+		if err == nil {
+			err = TheMIDILearner().Unlearn(r.padName, target)
+		}
+
 	default:
 		known = false
 	}
@@ -1138,6 +1463,61 @@ func (r *Reactor) ExecuteAPI(api string, args map[string]string, rawargs string)
 	return result, err
 }
 
+// midiSend sends an arbitrary MIDI message (e.g. SysEx)
+// to this region's synth, or to the synth given in the args
+func (r *Reactor) midiSend(api string, args map[string]string) error {
+	bytes, err := NeedStringArg("bytes", api, args)
+	if err != nil {
+		return err
+	}
+	msg, err := decodeMIDIBytes(bytes)
+	if err != nil {
+		return err
+	}
+	if msg[0] != 0xf0 && MIDIMessageLength(msg[0]) != len(msg) {
+		return fmt.Errorf("api=%s bytes=%s is not a complete MIDI message", api, bytes)
+	}
+	synth := OptionalStringArg("synth", args, r.params.ParamStringValue("sound.synth", defaultSynth))
+	MIDI.SendNote(NewBytes(msg, synth))
+	return nil
+}
+
+// midiLearn arms MIDI learning for a parameter or API of this region
+func (r *Reactor) midiLearn(api string, args map[string]string) error {
+	b := &MIDIBinding{Region: r.padName}
+	param := OptionalStringArg("param", args, "")
+	if param == "" {
+		target, err := NeedStringArg("api", api, args)
+		if err != nil {
+			return err
+		}
+		b.API = target
+		TheMIDILearner().Arm(b)
+		return nil
+	}
+	min, max, err := r.paramRange(param)
+	if err != nil {
+		return err
+	}
+	b.Param = param
+	b.Min = min
+	b.Max = max
+	if _, ok := args["min"]; ok {
+		b.Min, err = NeedFloatArg("min", api, args)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := args["max"]; ok {
+		b.Max, err = NeedFloatArg("max", api, args)
+		if err != nil {
+			return err
+		}
+	}
+	TheMIDILearner().Arm(b)
+	return nil
+}
+
 func (r *Reactor) loopComb() {
 
 	r.loop.stepsMutex.Lock()
@@ -1229,6 +1609,28 @@ func (r *Reactor) loopQuant() {
 	}
 }
 
+// sendVisualParam sends a visual.* parameter to the FreeFrame plugin,
+// the same way the visual.set_param API is forwarded
+func (r *Reactor) sendVisualParam(name string, value string) {
+	msg := osc.NewMessage("/api")
+	msg.Append("set_param")
+	msg.Append(fmt.Sprintf("{\"param\":\"%s\",\"value\":\"%s\"}", jsonEscape(name), jsonEscape(value)))
+	r.toFreeFramePluginForLayer(msg)
+}
+
+// sendVisualParams sends many visual parameters to the FreeFrame plugin at once
+func (r *Reactor) sendVisualParams(values map[string]string) {
+	bytes, err := json.Marshal(values)
+	if err != nil {
+		log.Printf("Reactor.sendVisualParams: err=%s\n", err)
+		return
+	}
+	msg := osc.NewMessage("/api")
+	msg.Append("set_params")
+	msg.Append(string(bytes))
+	r.toFreeFramePluginForLayer(msg)
+}
+
 func (r *Reactor) sendEffectParam(name string, value string) {
 	// Effect parameters that have ":" in their name are plugin parameters
 	i := strings.Index(name, ":")
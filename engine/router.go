@@ -3,6 +3,7 @@ package engine
 import (
 	"bufio"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -26,7 +27,7 @@ type Router struct {
 	reactors      map[string]*Reactor
 	inputs        []*osc.Client
 	OSCInput      chan OSCEvent
-	MIDIInput     chan portmidi.Event
+	MIDIInput     chan MIDIPortEvent
 
 	cursorCallbacks      []GestureDeviceCallbackFunc
 	killme               bool // true if Router should be stopped
@@ -50,6 +51,12 @@ type Router struct {
 	regionAssignedToNUID map[string]string
 	regionAssignedMutex  sync.RWMutex // covers both regionForMorph and regionAssignedToNUID
 	eventMutex           sync.RWMutex
+	midiRoutes           []MIDIRoute
+	midiRoutesMutex      sync.RWMutex
+	chordRecognizer      *ChordRecognizer
+	modulation           *Modulation
+	globalParams         *ParamValues
+	links                *paramLinks
 }
 
 // OSCEvent is an OSC message
@@ -58,6 +65,12 @@ type OSCEvent struct {
 	Source string
 }
 
+// MIDIPortEvent is a MIDI event from a particular MIDI input port
+type MIDIPortEvent struct {
+	Port  string
+	Event portmidi.Event
+}
+
 // Command is sent on the control channel of the Router
 type Command struct {
 	Action string // e.g. "addmidi"
@@ -93,6 +106,22 @@ type PlaybackEvent struct {
 var onceRouter sync.Once
 var oneRouter Router
 
+// regionJSONAPIs are the region APIs whose results are JSON
+var regionJSONAPIs = map[string]bool{
+	"layout":       true,
+	"voice_status": true,
+	"load_preset":  true,
+	"save_preset":  true,
+	"get_params":   true,
+}
+
+// isSetParamAPI returns true for the region set_param and set_params APIs,
+// with or without a prefix (e.g. sound.set_params), whose results are JSON
+func isSetParamAPI(api string) bool {
+	suffix := api[strings.LastIndex(api, ".")+1:]
+	return suffix == "set_param" || suffix == "set_params"
+}
+
 // APIExecutorFunc xxx
 type APIExecutorFunc func(api string, nuid string, rawargs string) (result interface{}, err error)
 
@@ -111,7 +140,12 @@ func TheRouter() *Router {
 
 		oneRouter.regionLetters = "ABCD"
 
-		err := LoadParamEnums()
+		// Scales are loaded first, since they're used in ParamEnums
+		err := LoadScales()
+		if err != nil {
+			log.Printf("LoadScales: err=%s, using builtin scales\n", err)
+		}
+		err = LoadParamEnums()
 		if err != nil {
 			log.Printf("LoadParamEnums: err=%s\n", err)
 			// might be fatal, but try to continue
@@ -126,6 +160,14 @@ func TheRouter() *Router {
 			log.Printf("LoadResolumeJSON: err=%s\n", err)
 			// might be fatal, but try to continue
 		}
+		err = LoadChords()
+		if err != nil {
+			log.Printf("LoadChords: err=%s\n", err)
+		}
+		err = LoadVelocityCurves()
+		if err != nil {
+			log.Printf("LoadVelocityCurves: err=%s\n", err)
+		}
 
 		oneRouter.cursorCallbacks = make([]GestureDeviceCallbackFunc, 0)
 		oneRouter.reactors = make(map[string]*Reactor)
@@ -144,8 +186,31 @@ func TheRouter() *Router {
 			oneRouter.reactors[ch] = NewReactor(ch, resolumeLayer, freeframeClient, oneRouter.resolumeClient, oneRouter.guiClient)
 		}
 
+		oneRouter.chordRecognizer = NewChordRecognizer()
+		oneRouter.modulation = NewModulation()
+		oneRouter.globalParams = NewParamValues()
+		oneRouter.links = &paramLinks{}
+		for _, reactor := range oneRouter.reactors {
+			reactor.params.SetParent(oneRouter.globalParams)
+		}
+		for _, reactor := range oneRouter.reactors {
+			reactor := reactor
+			reactor.activePhrasesManager.CallbackOnOutput(func(cid string, n *Note) {
+				// Only the MIDI file's notes (see midi_midifile) are followed
+				if strings.HasPrefix(cid, "midiplaych") {
+					oneRouter.followMIDIFileNote(reactor, n)
+				}
+			})
+		}
+
 		oneRouter.OSCInput = make(chan OSCEvent)
-		oneRouter.MIDIInput = make(chan portmidi.Event)
+		oneRouter.MIDIInput = make(chan MIDIPortEvent)
+
+		oneRouter.midiRoutes, err = parseMIDIRoutes(ConfigValue("midiroutes"))
+		if err != nil {
+			log.Printf("parseMIDIRoutes: err=%s\n", err)
+			oneRouter.midiRoutes = make([]MIDIRoute, 0)
+		}
 		oneRouter.recordingOn = false
 
 		oneRouter.myHostname = ConfigValue("hostname")
@@ -163,6 +228,17 @@ func TheRouter() *Router {
 		oneRouter.generateVisuals = ConfigBool("generatevisuals")
 		oneRouter.generateSound = ConfigBool("generatesound")
 
+		if ConfigBool("publishparams") {
+			notifier := newParamNotifier()
+			for _, reactor := range oneRouter.reactors {
+				region := reactor.padName
+				reactor.params.AddObserver(func(name, oldvalue, newvalue string) {
+					notifier.changed(region, name, oldvalue, newvalue)
+				})
+			}
+			go notifier.run(oneRouter.guiClient)
+		}
+
 		go oneRouter.notifyGUI("restart")
 	})
 	return &oneRouter
@@ -307,7 +383,7 @@ func StartMIDI() {
 					if DebugUtil.MIDI {
 						log.Printf("StartMIDI: input=%s event=%+v\n", nm, event)
 					}
-					r.MIDIInput <- event
+					r.MIDIInput <- MIDIPortEvent{Port: nm, Event: event}
 				}
 			}
 		}
@@ -322,7 +398,8 @@ func ListenForLocalDeviceInputsForever() {
 		select {
 		case msg := <-r.OSCInput:
 			r.HandleOSCInput(msg)
-		case event := <-r.MIDIInput:
+		case pe := <-r.MIDIInput:
+			event := pe.Event
 			if r.publishMIDI {
 				me := MIDIDeviceEvent{
 					Timestamp: int64(event.Timestamp),
@@ -335,10 +412,12 @@ func ListenForLocalDeviceInputsForever() {
 					log.Printf("Router.HandleDevieMIDIInput: me=%+v err=%s\n", me, err)
 				}
 			}
-			// XXX - All Pads??  I guess
-			for _, reactor := range r.reactors {
+			// Don't let MIDI input get handled while we're advancing
+			r.eventMutex.Lock()
+			for _, reactor := range r.reactorsForMIDIInput(pe.Port, event.Status) {
 				reactor.HandleMIDIDeviceInput(event)
 			}
+			r.eventMutex.Unlock()
 		default:
 			// log.Printf("Sleeping 1 ms - now=%v\n", time.Now())
 			time.Sleep(time.Millisecond)
@@ -440,6 +519,9 @@ func (r *Router) HandleSubscribedEventArgs(args map[string]string) error {
 
 		reactor.handleGestureDeviceEvent(ce)
 
+	case "param":
+		// Parameter changes are published for other clients, there's nothing to do
+
 	case "sprite":
 
 		api := "event.sprite"
@@ -471,7 +553,16 @@ func (r *Router) HandleSubscribedEventArgs(args map[string]string) error {
 			if err != nil {
 				return err
 			}
-			me, err := r.makeMIDIEvent(subEvent, bytes, args)
+			msg, err := decodeMIDIBytes(bytes)
+			if err != nil {
+				return err
+			}
+			// SysEx doesn't fit in a portmidi.Event
+			if msg[0] == 0xf0 {
+				reactor.HandleMIDISysEx(msg)
+				return nil
+			}
+			me, err := r.makeMIDIEvent(subEvent, msg, args)
 			if err != nil {
 				return err
 			}
@@ -506,8 +597,34 @@ func (r *Router) handleGestureDeviceInput(e GestureDeviceEvent) {
 	reactor.handleGestureDeviceEvent(e)
 }
 
-// makeMIDIEvent xxx
-func (r *Router) makeMIDIEvent(subEvent string, bytes string, args map[string]string) (*portmidi.Event, error) {
+// decodeMIDIBytes decodes a hex string like "0x903c7f" into a MIDI message
+func decodeMIDIBytes(bytes string) ([]byte, error) {
+	// We expect the string to start with 0x
+	if len(bytes) < 2 || bytes[0:2] != "0x" {
+		return nil, fmt.Errorf("decodeMIDIBytes: invalid bytes value - %s", bytes)
+	}
+	hexstring := bytes[2:]
+	src := []byte(hexstring)
+	bytearr := make([]byte, hex.DecodedLen(len(src)))
+	nbytes, err := hex.Decode(bytearr, src)
+	if err != nil {
+		return nil, fmt.Errorf("decodeMIDIBytes: unable to decode hex bytes = %s", bytes)
+	}
+	if nbytes == 0 {
+		return nil, fmt.Errorf("decodeMIDIBytes: no bytes in %s", bytes)
+	}
+	bytearr = bytearr[:nbytes]
+	if bytearr[0]&0x80 == 0 {
+		return nil, fmt.Errorf("decodeMIDIBytes: first byte isn't a status byte - %s", bytes)
+	}
+	if bytearr[0] == 0xf0 && bytearr[nbytes-1] != 0xf7 {
+		return nil, fmt.Errorf("decodeMIDIBytes: sysex doesn't end with 0xf7 - %s", bytes)
+	}
+	return bytearr, nil
+}
+
+// makeMIDIEvent makes a portmidi.Event from a 1, 2, or 3-byte MIDI message
+func (r *Router) makeMIDIEvent(subEvent string, msg []byte, args map[string]string) (*portmidi.Event, error) {
 
 	var timestamp int64
 	s := OptionalStringArg("time", args, "")
@@ -519,33 +636,18 @@ func (r *Router) makeMIDIEvent(subEvent string, bytes string, args map[string]st
 		timestamp = int64(f * 1000.0)
 	}
 
-	// We expect the string to start with 0x
-	if len(bytes) < 2 || bytes[0:2] != "0x" {
-		return nil, fmt.Errorf("makeMIDIEvent: invalid bytes value - %s", bytes)
+	nbytes := MIDIMessageLength(msg[0])
+	if nbytes <= 0 || len(msg) != nbytes {
+		return nil, fmt.Errorf("makeMIDIEvent: unable to handle midi bytes len=%d status=0x%02x", len(msg), msg[0])
 	}
-	hexstring := bytes[2:]
-	src := []byte(hexstring)
-	bytearr := make([]byte, hex.DecodedLen(len(src)))
-	nbytes, err := hex.Decode(bytearr, src)
-	if err != nil {
-		return nil, fmt.Errorf("makeMIDIEvent: unable to decode hex bytes = %s", bytes)
-	}
-	status := 0
+	status := int(msg[0])
 	data1 := 0
 	data2 := 0
-	switch nbytes {
-	case 0:
-		return nil, fmt.Errorf("makeMIDIEvent: unable to handle midi bytes len=%d", nbytes)
-	case 1:
-		return nil, fmt.Errorf("makeMIDIEvent: unable to handle midi bytes len=%d", nbytes)
-	case 2:
-		return nil, fmt.Errorf("makeMIDIEvent: unable to handle midi bytes len=%d", nbytes)
-	case 3:
-		status = int(bytearr[0])
-		data1 = int(bytearr[1])
-		data2 = int(bytearr[2])
-	default:
-		return nil, fmt.Errorf("makeMIDIEvent: unable to handle midi bytes len=%d", nbytes)
+	if nbytes > 1 {
+		data1 = int(msg[1])
+	}
+	if nbytes > 2 {
+		data2 = int(msg[2])
 	}
 
 	me := &portmidi.Event{
@@ -662,7 +764,15 @@ func (r *Router) ExecuteAPI(api string, nuid string, rawargs string) (result int
 		if !ok {
 			return nil, fmt.Errorf("api/event=%s there is no region named %s", api, region)
 		}
-		return reactor.ExecuteAPI(apisuffix, args, rawargs)
+		regionResult, err := reactor.ExecuteAPI(apisuffix, args, rawargs)
+		if err != nil {
+			return nil, err
+		}
+		// The results that are JSON are returned as they are, not as a JSON string
+		if regionJSONAPIs[apisuffix] || isSetParamAPI(apisuffix) {
+			return json.RawMessage(regionResult), nil
+		}
+		return regionResult, nil
 	}
 
 	// Everything else should be "global", eventually I'll factor this
@@ -727,6 +837,86 @@ func (r *Router) ExecuteAPI(api string, nuid string, rawargs string) (result int
 	case "audio_reset":
 		r.audioReset()
 
+	case "panic":
+		MIDI.Panic()
+		// All the notes are off, so the regions have no sounding voices
+		for _, reactor := range r.reactors {
+			reactor.clearTunedNotes()
+			reactor.voices.clear()
+		}
+
+	case "sounding_notes":
+		result = MIDI.SoundingNotes()
+
+	case "midi_offset":
+		var port string
+		var ms int
+		port, err = NeedStringArg("port", api, args)
+		if err == nil {
+			ms, err = NeedIntArg("offset", api, args)
+		}
+		if err == nil {
+			err = MIDI.SetOffset(port, ms)
+		}
+
+	case "midi_offsets":
+		result = MIDI.Offsets()
+
+	case "load_scales":
+		err = LoadScales()
+
+	case "list_scales":
+		result = ScaleDefs()
+
+	case "chord_latch":
+		var onoff bool
+		onoff, err = NeedBoolArg("onoff", api, args)
+		if err == nil {
+			r.chordRecognizer.SetLatch(onoff)
+		}
+
+	case "chord_midifile":
+		var onoff bool
+		onoff, err = NeedBoolArg("onoff", api, args)
+		if err == nil {
+			r.chordRecognizer.SetFollowMIDIFile(onoff)
+		}
+
+	case "chord_current":
+		result = r.chordRecognizer.Current()
+
+	case "ramp_params":
+		err = r.rampParams(api, args)
+
+	case "mod_set", "mod_delete", "mod_route", "mod_unroute",
+		"mod_list", "mod_clear", "mod_load", "mod_save":
+		result, err = r.modulationAPI(apisuffix, api, args)
+
+	case "describe_params":
+		result = describeParams(args)
+
+	case "set_param", "set_params", "get_params", "clear_param",
+		"link_params", "unlink_params", "list_links", "copy_params":
+		result, err = r.globalParamsAPI(apisuffix, api, args)
+
+	case "midilearn_list":
+		result = TheMIDILearner().Bindings()
+
+	case "midilearn_clear":
+		err = TheMIDILearner().Clear()
+
+	case "midi_route_add":
+		err = r.addMIDIRoute(api, args)
+
+	case "midi_route_remove":
+		err = r.removeMIDIRoute(api, args)
+
+	case "midi_route_clear":
+		r.clearMIDIRoutes()
+
+	case "midi_route_list":
+		result = r.listMIDIRoutes()
+
 	case "recordingStart":
 		r.recordingOn = true
 		if r.recordingFile != nil {
@@ -786,13 +976,18 @@ func (r *Router) advanceClickTo(toClick Clicks) {
 	defer r.eventMutex.Unlock()
 
 	for clk := r.lastClick; clk < toClick; clk++ {
+		advanceClick = clk
+		// MIDI output for this click is timestamped for when it should happen
+		MIDI.setOutputLag(CurrentMilli - Clicks2Milli(clk))
 		for _, reactor := range r.reactors {
 			if (clk % oneBeat) == 0 {
 				reactor.checkGestureUp()
 			}
 			reactor.AdvanceByOneClick()
 		}
+		r.modulation.advance(clk, r.reactors)
 	}
+	MIDI.setOutputLag(0)
 	r.lastClick = toClick
 }
 
@@ -1,48 +1,165 @@
 package engine
 
-import "log"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
 
 // Scale says whether a pitch is in a scale
 type Scale struct {
 	hasNote [128]bool
 }
 
-// Scales maps a name to a Scale
-var Scales map[string]*Scale
+// ScaleDef is the definition of a scale, as found in scales.json
+type ScaleDef struct {
+	Name        string `json:"name"`
+	Intervals   []int  `json:"intervals"` // semitones above the root
+	Description string `json:"description"`
+	inKey       [12]*Scale
+}
+
+// Scales maps a name to a ScaleDef
+var Scales map[string]*ScaleDef
+
+// ScaleNames are the names of the scales, in the order they were defined
+var ScaleNames []string
+
+var scalesMutex sync.RWMutex
+
+// chromaticScale is used when a scale can't be found
+var chromaticScale = makeScale(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+
+// KeyNames are the values of the misc.key parameter
+var KeyNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// KeyOf returns the number of semitones above C of a key name
+func KeyOf(name string) (int, error) {
+	for i, k := range KeyNames {
+		if strings.EqualFold(k, name) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no key named %s", name)
+}
 
-// GlobalScale xxx
-func GlobalScale(name string) *Scale {
-	s, ok := Scales[name]
+// GlobalScale returns a named scale, in the key that's
+// the given number of semitones above C
+func GlobalScale(name string, key int) (*Scale, error) {
+	scalesMutex.RLock()
+	defer scalesMutex.RUnlock()
+	def, ok := Scales[name]
 	if !ok {
-		log.Printf("No scale named %s, assuming newage\n", name)
-		s = Scales["newage"]
+		return nil, fmt.Errorf("no scale named %s", name)
 	}
-	return s
+	return def.inKey[((key%12)+12)%12], nil
 }
 
-// InitScales xxx
+// ScaleDefs returns the definitions of all scales, in order
+func ScaleDefs() []ScaleDef {
+	scalesMutex.RLock()
+	defer scalesMutex.RUnlock()
+	defs := make([]ScaleDef, 0, len(ScaleNames))
+	for _, nm := range ScaleNames {
+		def := Scales[nm]
+		defs = append(defs, ScaleDef{Name: def.Name, Intervals: def.Intervals, Description: def.Description})
+	}
+	return defs
+}
+
+// InitScales initializes the builtin scales,
+// which are used if scales.json can't be loaded
 func InitScales() {
+	setScales([]*ScaleDef{
+		{Name: "newage", Intervals: []int{0, 3, 5, 7, 10}},
+		{Name: "arabian", Intervals: []int{0, 1, 4, 5, 7, 8, 10}},
+		{Name: "ionian", Intervals: []int{0, 2, 4, 5, 7, 9, 11}},
+		{Name: "dorian", Intervals: []int{0, 2, 3, 5, 7, 9, 10}},
+		{Name: "phrygian", Intervals: []int{0, 1, 3, 5, 7, 8, 10}},
+		{Name: "lydian", Intervals: []int{0, 2, 4, 6, 7, 9, 11}},
+		{Name: "mixolydian", Intervals: []int{0, 2, 4, 5, 7, 9, 10}},
+		{Name: "aeolian", Intervals: []int{0, 2, 3, 5, 7, 8, 10}},
+		{Name: "locrian", Intervals: []int{0, 1, 3, 5, 6, 8, 10}},
+		{Name: "octaves", Intervals: []int{0}},
+		{Name: "harminor", Intervals: []int{0, 2, 3, 5, 7, 8, 11}},
+		{Name: "melminor", Intervals: []int{0, 2, 3, 5, 7, 9, 11}},
+		{Name: "chromatic", Intervals: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{Name: "fifths", Intervals: []int{0, 7}},
+		{Name: "raga1", Intervals: []int{0, 1, 4, 5, 7, 8, 11}},
+		{Name: "raga2", Intervals: []int{0, 2, 4, 6, 7, 9, 11}},
+		{Name: "raga3", Intervals: []int{0, 2, 3, 5, 9, 10}},
+		{Name: "raga4", Intervals: []int{0, 1, 4, 6, 7, 8, 11}},
+	})
+}
+
+// LoadScales reads the scale definitions in scales.json, replacing the current ones
+func LoadScales() error {
+
+	path := ConfigFilePath("scales.json")
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("LoadScales: unable to read path=%s", path)
+	}
+	var f struct {
+		Scales []*ScaleDef `json:"scales"`
+	}
+	err = json.Unmarshal(bytes, &f)
+	if err != nil {
+		return fmt.Errorf("LoadScales: unable to Unmarshal path=%s, err=%s", path, err)
+	}
+	if len(f.Scales) == 0 {
+		return fmt.Errorf("LoadScales: no scales in path=%s", path)
+	}
+	for _, def := range f.Scales {
+		if def.Name == "" || def.Name == "external" {
+			return fmt.Errorf("LoadScales: invalid scale name (%s) in path=%s", def.Name, path)
+		}
+		if len(def.Intervals) == 0 {
+			return fmt.Errorf("LoadScales: scale %s has no intervals", def.Name)
+		}
+		for _, i := range def.Intervals {
+			if i < 0 || i > 11 {
+				return fmt.Errorf("LoadScales: scale %s has invalid interval %d", def.Name, i)
+			}
+		}
+	}
+	setScales(f.Scales)
+	return nil
+}
+
+func setScales(defs []*ScaleDef) {
+	newScales := make(map[string]*ScaleDef)
+	newNames := make([]string, 0, len(defs))
+	for _, def := range defs {
+		for key := 0; key < 12; key++ {
+			pitches := make([]int, len(def.Intervals))
+			for i, interval := range def.Intervals {
+				pitches[i] = (interval + key) % 12
+			}
+			def.inKey[key] = makeScale(pitches...)
+		}
+		if _, ok := newScales[def.Name]; !ok {
+			newNames = append(newNames, def.Name)
+		}
+		newScales[def.Name] = def
+	}
 
-	Scales = make(map[string]*Scale)
-	Scales["raga1"] = makeScale(0, 1, 4, 5, 7, 8, 11)
-	Scales["raga2"] = makeScale(0, 2, 4, 6, 7, 9, 11)
-	Scales["raga3"] = makeScale(0, 2, 3, 5, 9, 10)
-	Scales["raga4"] = makeScale(0, 1, 4, 6, 7, 8, 11)
-
-	Scales["arabian"] = makeScale(0, 1, 4, 5, 7, 8, 10)
-	Scales["newage"] = makeScale(0, 3, 5, 7, 10)
-	Scales["ionian"] = makeScale(0, 2, 4, 5, 7, 9, 11)
-	Scales["dorian"] = makeScale(0, 2, 3, 5, 7, 9, 10)
-	Scales["phrygian"] = makeScale(0, 1, 3, 5, 7, 8, 10)
-	Scales["lydian"] = makeScale(0, 2, 4, 6, 7, 9, 11)
-	Scales["mixolydian"] = makeScale(0, 2, 4, 5, 7, 9, 10)
-	Scales["aeolian"] = makeScale(0, 2, 3, 5, 7, 8, 10)
-	Scales["locrian"] = makeScale(0, 1, 3, 5, 6, 8, 10)
-	Scales["octaves"] = makeScale(0)
-	Scales["harminor"] = makeScale(0, 2, 3, 5, 7, 8, 11)
-	Scales["melminor"] = makeScale(0, 2, 3, 5, 7, 9, 11)
-	Scales["chromatic"] = makeScale(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
-	Scales["fifths"] = makeScale(0, 7)
+	scalesMutex.Lock()
+	Scales = newScales
+	ScaleNames = newNames
+	scalesMutex.Unlock()
+
+	SetParamEnum("scale", scaleEnum())
+}
+
+// scaleEnum returns the values of the misc.scale parameter, which are the
+// loaded scales plus "external", i.e. the scale set by MIDI input.
+func scaleEnum() []string {
+	scalesMutex.RLock()
+	defer scalesMutex.RUnlock()
+	return append([]string{"external"}, ScaleNames...)
 }
 
 func makeScale(pitches ...int) *Scale {
@@ -75,6 +192,28 @@ func (s *Scale) ClosestToOriginal(pitch uint8) uint8 {
 	return uint8(closestpitch)
 }
 
+// StepsAbove returns the pitch that's a number of scale steps
+// above (or below, if steps is negative) a pitch.
+// It returns false if that's outside the MIDI range.
+func (s *Scale) StepsAbove(pitch uint8, steps int) (uint8, bool) {
+	p := int(pitch)
+	dir := 1
+	if steps < 0 {
+		dir = -1
+		steps = -steps
+	}
+	for ; steps > 0; steps-- {
+		p += dir
+		for p >= 0 && p <= 127 && !s.hasNote[p] {
+			p += dir
+		}
+		if p < 0 || p > 127 {
+			return pitch, false
+		}
+	}
+	return uint8(p), true
+}
+
 // ClosestTo xxx
 // New version, faster
 func (s *Scale) ClosestTo(pitch uint8) uint8 {
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// numSliders is the number of virtual sliders in each region,
+// defined by the sliders.slider{N}param, slider{N}modify,
+// and slider{N}value parameters
+const numSliders = 8
+
+// sliderBase is the value of a slider's target parameter
+// before the slider (with sliderModify "scale") changed it
+type sliderBase struct {
+	param string
+	value float32
+}
+
+// sliders holds the sliderBase of each slider of a Reactor
+type sliders struct {
+	mutex    sync.Mutex
+	bases    [numSliders]*sliderBase
+	applying string // the target parameter that a slider is setting
+}
+
+// sliderNum returns the slider number (1-8) of a sliders.slider{N}* parameter, or 0
+func sliderNum(name string) (int, string) {
+	if !strings.HasPrefix(name, "sliders.slider") || len(name) < len("sliders.slider")+1 {
+		return 0, ""
+	}
+	n := int(name[len("sliders.slider")] - '0')
+	if n < 1 || n > numSliders {
+		return 0, ""
+	}
+	return n, name[len("sliders.slider")+1:]
+}
+
+// sliderTarget returns the full name of the parameter controlled by a slider.
+// The sliderParam values are the names used in the GUI, e.g. "sizeinitial".
+func (r *Reactor) sliderTarget(n int) (string, error) {
+	target := r.params.ParamStringValue(fmt.Sprintf("sliders.slider%dparam", n), "")
+	if target == "" {
+		return "", fmt.Errorf("slider %d has no parameter", n)
+	}
+	if strings.HasPrefix(target, "sliders.") {
+		return "", fmt.Errorf("slider %d can't control another slider (%s)", n, target)
+	}
+	if strings.Contains(target, ".") {
+		if _, _, err := r.paramRange(target); err == nil {
+			return target, nil
+		}
+	}
+	return presetParamName("snap", target)
+}
+
+// applySlider sets the target parameter of a slider from its value.
+// With sliderModify "replace", the slider covers the whole range of the parameter.
+// With "scale", it moves the parameter away from the value it had before
+// the slider was moved, by up to the whole range of the parameter in either
+// direction, i.e. it's unchanged at 0.5.
+func (r *Reactor) applySlider(n int) error {
+	target, err := r.sliderTarget(n)
+	if err != nil {
+		return err
+	}
+	v := r.params.ParamFloatValue(fmt.Sprintf("sliders.slider%dvalue", n))
+	modify := r.params.ParamStringValue(fmt.Sprintf("sliders.slider%dmodify", n), "replace")
+
+	def, err := r.params.paramDefOf(target)
+	if err != nil {
+		return err
+	}
+	var value string
+	switch d := def.typedParamDef.(type) {
+	case paramDefInt, paramDefFloat:
+		min, max, _ := r.paramRange(target)
+		f := min + (max-min)*v
+		if modify == "scale" {
+			base, err := r.sliderBaseValue(n, target)
+			if err != nil {
+				return err
+			}
+			f = base + (v-0.5)*2.0*(max-min)
+			if f < min {
+				f = min
+			} else if f > max {
+				f = max
+			}
+		}
+		if _, isInt := d.(paramDefInt); isInt {
+			value = strconv.Itoa(int(math.Round(float64(f))))
+		} else {
+			value = fmt.Sprintf("%f", f)
+		}
+	case paramDefBool:
+		value = strconv.FormatBool(v >= 0.5)
+	case paramDefString:
+		if len(d.values) == 0 {
+			return fmt.Errorf("slider %d: parameter %s has no enumerated values", n, target)
+		}
+		i := clampInt(int(v*float32(len(d.values))), 0, len(d.values)-1)
+		value = d.values[i]
+	default:
+		return fmt.Errorf("slider %d: unknown parameter %s", n, target)
+	}
+	s := r.sliders
+	s.mutex.Lock()
+	s.applying = target
+	s.mutex.Unlock()
+	err = r.applyParam(target, value)
+	s.mutex.Lock()
+	s.applying = ""
+	s.mutex.Unlock()
+	return err
+}
+
+// sliderBaseValue returns the value that a "scale" slider scales, which is
+// the value its target parameter had when the slider was first moved
+func (r *Reactor) sliderBaseValue(n int, target string) (float32, error) {
+	s := r.sliders
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	base := s.bases[n-1]
+	if base == nil || base.param != target {
+		v, _, err := r.params.paramNumericValue(target)
+		if err != nil {
+			return 0, err
+		}
+		base = &sliderBase{param: target, value: v}
+		s.bases[n-1] = base
+	}
+	return base.value, nil
+}
+
+// sliderParamChanged is called whenever a parameter is set (see setParams).
+// Setting a slider's value moves its target, and setting its target parameter
+// (other than by the slider) makes that the new base value for "scale".
+func (r *Reactor) sliderParamChanged(name string) {
+	if n, suffix := sliderNum(name); n > 0 {
+		if suffix == "value" {
+			err := r.applySlider(n)
+			if err != nil {
+				log.Printf("Reactor.sliderParamChanged: region=%s err=%s\n", r.padName, err)
+			}
+		}
+		return
+	}
+	s := r.sliders
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if name == s.applying {
+		return
+	}
+	for i, base := range s.bases {
+		if base != nil && base.param == name {
+			s.bases[i] = nil
+		}
+	}
+}
+
+// setSlider is the slider API
+func (r *Reactor) setSlider(api string, args map[string]string) error {
+	n, err := NeedIntArg("slider", api, args)
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > numSliders {
+		return fmt.Errorf("api=%s slider must be 1-%d", api, numSliders)
+	}
+	v, err := NeedFloatArg("value", api, args)
+	if err != nil {
+		return err
+	}
+	if _, err := r.sliderTarget(n); err != nil {
+		return fmt.Errorf("api=%s %s", api, err)
+	}
+	// Setting the slider's value moves its target (see sliderParamChanged)
+	name := fmt.Sprintf("sliders.slider%dvalue", n)
+	r.cancelRamp(name)
+	return r.applyParam(name, fmt.Sprintf("%f", v))
+}
@@ -161,3 +161,8 @@ func ChangeClicksPerSecond(factor float64) {
 func Seconds2Clicks(tm float64) Clicks {
 	return currentClickOffset + Clicks(0.5+float64(tm*1000-float64(currentMilliOffset))*(float64(clicksPerSecond)/1000.0))
 }
+
+// Clicks2Milli converts Clicks to the time (elapsed milliseconds) they should happen
+func Clicks2Milli(clk Clicks) int {
+	return currentMilliOffset + int(0.5+float64(clk-currentClickOffset)*1000.0/float64(clicksPerSecond))
+}
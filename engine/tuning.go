@@ -0,0 +1,429 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tuning is a microtonal tuning, read from a Scala .scl file
+// and (optionally) a Scala .kbm keyboard mapping file.
+type Tuning struct {
+	Description string
+	cents       []float64 // cents of degrees 1..n, the last one is the period (usually an octave)
+
+	// keyboard mapping
+	mapSize      int // 0 means a linear mapping, i.e. each key is the next degree
+	firstNote    int // lowest key that's mapped
+	lastNote     int // highest key that's mapped
+	middleNote   int // the key that plays degree 0
+	refNote      int // the key whose frequency is refFreq
+	refFreq      float64
+	octaveDegree int   // the degree that's the period of the mapping
+	mapping      []int // degree of each key in the mapping, -1 if unmapped
+
+	keys *Scale // the keys that are mapped
+}
+
+// TuningFilePath returns the path of a .scl or .kbm file
+func TuningFilePath(nm string) string {
+	local := filepath.Join(LocalMontageDir(), "tunings", nm)
+	if fileExists(local) {
+		return local
+	}
+	return ConfigFilePath(filepath.Join("tunings", nm))
+}
+
+// scalaLines returns the non-comment lines of a Scala file
+func scalaLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r\n")
+		if strings.HasPrefix(line, "!") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseScalaPitch parses a pitch in a .scl file, which is
+// either cents (if it contains a period) or a ratio
+func parseScalaPitch(s string) (float64, error) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return 0, fmt.Errorf("empty pitch value")
+	}
+	s = words[0]
+	if strings.Contains(s, ".") {
+		return strconv.ParseFloat(s, 64)
+	}
+	num := s
+	den := "1"
+	if slash := strings.Index(s, "/"); slash >= 0 {
+		num = s[:slash]
+		den = s[slash+1:]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, err
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 || d <= 0 {
+		return 0, fmt.Errorf("invalid ratio %s", s)
+	}
+	return 1200.0 * math.Log2(n/d), nil
+}
+
+// LoadTuning reads a .scl file, and a .kbm file if kbmpath isn't ""
+func LoadTuning(sclpath string, kbmpath string) (*Tuning, error) {
+
+	lines, err := scalaLines(sclpath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadTuning: unable to read %s, err=%s", sclpath, err)
+	}
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("LoadTuning: %s is too short", sclpath)
+	}
+	t := &Tuning{
+		Description:  strings.TrimSpace(lines[0]),
+		firstNote:    0,
+		lastNote:     127,
+		middleNote:   60,
+		refNote:      60,
+		refFreq:      261.6255653,
+		octaveDegree: 0,
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(lines[1]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LoadTuning: %s has a bad number of notes (%s)", sclpath, lines[1])
+	}
+	if len(lines) < 2+n {
+		return nil, fmt.Errorf("LoadTuning: %s has fewer than %d notes", sclpath, n)
+	}
+	t.cents = make([]float64, n)
+	for i := 0; i < n; i++ {
+		t.cents[i], err = parseScalaPitch(strings.TrimSpace(lines[2+i]))
+		if err != nil {
+			return nil, fmt.Errorf("LoadTuning: %s has a bad pitch (%s), err=%s", sclpath, lines[2+i], err)
+		}
+	}
+	t.octaveDegree = n
+
+	if kbmpath != "" {
+		err = t.loadKeyboardMapping(kbmpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := &Scale{}
+	for key := 0; key < 128; key++ {
+		_, ok := t.degreeOf(key)
+		keys.hasNote[key] = ok
+	}
+	t.keys = keys
+	return t, nil
+}
+
+func (t *Tuning) loadKeyboardMapping(path string) error {
+	lines, err := scalaLines(path)
+	if err != nil {
+		return fmt.Errorf("LoadTuning: unable to read %s, err=%s", path, err)
+	}
+	if len(lines) < 7 {
+		return fmt.Errorf("LoadTuning: %s is too short", path)
+	}
+	ints := make([]int, 7)
+	for i := 0; i < 7; i++ {
+		if i == 5 {
+			continue // the reference frequency
+		}
+		ints[i], err = strconv.Atoi(strings.Fields(lines[i] + " x")[0])
+		if err != nil {
+			return fmt.Errorf("LoadTuning: %s has a bad value (%s) on line %d", path, lines[i], i+1)
+		}
+	}
+	t.mapSize = ints[0]
+	t.firstNote = ints[1]
+	t.lastNote = ints[2]
+	t.middleNote = ints[3]
+	t.refNote = ints[4]
+	t.octaveDegree = ints[6]
+	t.refFreq, err = strconv.ParseFloat(strings.Fields(lines[5] + " x")[0], 64)
+	if err != nil || t.refFreq <= 0 {
+		return fmt.Errorf("LoadTuning: %s has a bad reference frequency (%s)", path, lines[5])
+	}
+	if t.mapSize < 0 || len(lines) < 7+t.mapSize {
+		return fmt.Errorf("LoadTuning: %s has fewer than %d mapping entries", path, t.mapSize)
+	}
+	t.mapping = make([]int, t.mapSize)
+	for i := 0; i < t.mapSize; i++ {
+		w := strings.Fields(lines[7+i] + " x")[0]
+		if w == "x" {
+			t.mapping[i] = -1
+			continue
+		}
+		t.mapping[i], err = strconv.Atoi(w)
+		if err != nil {
+			return fmt.Errorf("LoadTuning: %s has a bad mapping entry (%s)", path, lines[7+i])
+		}
+	}
+	if t.mapSize == 0 || t.octaveDegree == 0 {
+		t.octaveDegree = len(t.cents)
+	}
+	return nil
+}
+
+func floorDiv(a, b int) (q int, r int) {
+	q = a / b
+	r = a % b
+	if r < 0 {
+		q--
+		r += b
+	}
+	return q, r
+}
+
+// degreeOf returns the tuning degree played by a key
+func (t *Tuning) degreeOf(key int) (int, bool) {
+	if key < t.firstNote || key > t.lastNote {
+		return 0, false
+	}
+	d := key - t.middleNote
+	if t.mapSize == 0 {
+		return d, true
+	}
+	octaves, i := floorDiv(d, t.mapSize)
+	if t.mapping[i] < 0 {
+		return 0, false
+	}
+	return octaves*t.octaveDegree + t.mapping[i], true
+}
+
+// centsOf returns the cents (above degree 0) of a degree
+func (t *Tuning) centsOf(degree int) float64 {
+	n := len(t.cents)
+	periods, i := floorDiv(degree, n)
+	c := float64(periods) * t.cents[n-1]
+	if i > 0 {
+		c += t.cents[i-1]
+	}
+	return c
+}
+
+// Frequency returns the frequency of a key
+func (t *Tuning) Frequency(key int) (float64, bool) {
+	degree, ok := t.degreeOf(key)
+	if !ok {
+		return 0, false
+	}
+	// The reference note doesn't have to be mapped
+	refDegree := t.refNote - t.middleNote
+	if t.mapSize > 0 {
+		octaves, i := floorDiv(refDegree, t.mapSize)
+		refDegree = octaves * t.octaveDegree
+		if t.mapping[i] > 0 {
+			refDegree += t.mapping[i]
+		}
+	}
+	cents := t.centsOf(degree) - t.centsOf(refDegree)
+	return t.refFreq * math.Pow(2.0, cents/1200.0), true
+}
+
+// KeysPerPeriod returns the number of keys in the repeating
+// part of the mapping, i.e. the keys in an "octave"
+func (t *Tuning) KeysPerPeriod() int {
+	if t.mapSize > 0 {
+		return t.mapSize
+	}
+	return len(t.cents)
+}
+
+// IsTwelveTone returns true if the tuning has 12 keys per octave,
+// in which case the usual 12-note scales still make sense
+func (t *Tuning) IsTwelveTone() bool {
+	return t.KeysPerPeriod() == 12
+}
+
+// frequencyToMIDI returns the closest MIDI note of a frequency,
+// and the difference (in semitones) from that note.
+func frequencyToMIDI(freq float64) (uint8, float64) {
+	m := 69.0 + 12.0*math.Log2(freq/440.0)
+	n := math.Round(m)
+	if n < 0 {
+		n = 0
+	} else if n > 127 {
+		n = 127
+	}
+	return uint8(n), m - n
+}
+
+// mtsRetune returns the MIDI Tuning Standard (real-time single note
+// tuning change) SysEx message that retunes a key to a frequency
+func mtsRetune(key uint8, freq float64) []byte {
+	n, frac := frequencyToMIDI(freq)
+	if frac < 0 {
+		if n > 0 {
+			n--
+			frac += 1.0
+		} else {
+			frac = 0
+		}
+	}
+	f14 := int(frac * 16384.0)
+	if f14 > 16383 {
+		f14 = 16383
+	}
+	return []byte{0xf0, 0x7f, 0x7f, 0x08, 0x02, 0x00, 0x01,
+		key & 0x7f, n, byte(f14>>7) & 0x7f, byte(f14) & 0x7f, 0xf7}
+}
+
+// tunedNote is a NOTEON that's been sent with a tuning
+type tunedNote struct {
+	key     uint8 // the original pitch
+	noteOn  *Note // the NOTEON that was actually sent
+	channel int   // channel offset used for it
+}
+
+// tuner applies a region's tuning to the notes it sends
+type tuner struct {
+	mutex       sync.Mutex
+	sclName     string
+	kbmName     string
+	tuning      *Tuning
+	nextChannel int
+	sounding    []*tunedNote
+}
+
+// getTuning returns the region's tuning, or nil if it uses 12-TET
+func (r *Reactor) getTuning() *Tuning {
+	scl := r.params.ParamStringValue("sound.tuning", "")
+	kbm := r.params.ParamStringValue("sound.tuningkbm", "")
+	t := r.tuner
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if scl == t.sclName && kbm == t.kbmName {
+		return t.tuning
+	}
+	t.sclName = scl
+	t.kbmName = kbm
+	t.tuning = nil
+	if scl == "" {
+		return nil
+	}
+	kbmpath := ""
+	if kbm != "" {
+		kbmpath = TuningFilePath(kbm)
+	}
+	tuning, err := LoadTuning(TuningFilePath(scl), kbmpath)
+	if err != nil {
+		log.Printf("Reactor.getTuning: region=%s err=%s\n", r.padName, err)
+		return nil
+	}
+	t.tuning = tuning
+	return tuning
+}
+
+// sendTunedNote sends a Note, applying the region's tuning (if any)
+func (r *Reactor) sendTunedNote(n *Note) {
+	tuning := r.getTuning()
+	if tuning == nil || !n.IsNote() {
+		MIDI.SendNote(n)
+		return
+	}
+	if n.TypeOf == NOTEON && n.Velocity == 0 {
+		n = NewNoteOff(n.Pitch, 0, n.Sound)
+	}
+	mode := r.params.ParamStringValue("sound.tuningoutput", "bend")
+	t := r.tuner
+
+	switch n.TypeOf {
+	case NOTEON:
+		freq, ok := tuning.Frequency(int(n.Pitch))
+		if !ok {
+			return // unmapped keys don't play
+		}
+		if mode == "mts" {
+			MIDI.SendNote(NewBytes(mtsRetune(n.Pitch, freq), n.Sound))
+			MIDI.SendNote(n)
+			return
+		}
+		// Each note gets its own channel, so it can have its own pitch bend
+		pitch, frac := frequencyToMIDI(freq)
+		bendrange := r.params.ParamIntValue("sound.bendrange")
+		if bendrange < 1 {
+			bendrange = 2
+		}
+		bend := 8192 + int(math.Round(frac/float64(bendrange)*8192.0))
+		if bend < 0 {
+			bend = 0
+		} else if bend > 16383 {
+			bend = 16383
+		}
+		nchannels := r.params.ParamIntValue("sound.tuningchannels")
+		if nchannels < 1 {
+			nchannels = 1
+		}
+		t.mutex.Lock()
+		channel := t.nextChannel % nchannels
+		t.nextChannel = channel + 1
+		noteOn := NewNoteOn(pitch, n.Velocity, n.Sound)
+		noteOn.channelOffset = channel
+		t.sounding = append(t.sounding, &tunedNote{key: n.Pitch, noteOn: noteOn, channel: channel})
+		t.mutex.Unlock()
+
+		pb := NewPitchBend(uint8(bend&0x7f), uint8(bend>>7), n.Sound)
+		pb.channelOffset = channel
+		MIDI.SendNote(pb)
+		MIDI.SendNote(noteOn)
+
+	case NOTEOFF:
+		if mode == "mts" {
+			MIDI.SendNote(n)
+			return
+		}
+		var tn *tunedNote
+		t.mutex.Lock()
+		for i, s := range t.sounding {
+			if s.key == n.Pitch && s.noteOn.Sound == n.Sound {
+				tn = s
+				t.sounding = append(t.sounding[:i], t.sounding[i+1:]...)
+				break
+			}
+		}
+		t.mutex.Unlock()
+		if tn == nil {
+			return
+		}
+		noteOff := NewNoteOff(tn.noteOn.Pitch, n.Velocity, n.Sound)
+		noteOff.channelOffset = tn.channel
+		MIDI.SendNote(noteOff)
+
+	default:
+		MIDI.SendNote(n)
+	}
+}
+
+// clearTunedNotes forgets the notes that have been sent with a tuning,
+// which happens when all-notes-off is sent
+func (r *Reactor) clearTunedNotes() {
+	r.tuner.mutex.Lock()
+	r.tuner.sounding = nil
+	r.tuner.mutex.Unlock()
+}
@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// VelocityCurve maps an input value (e.g. the pressure or y of a gesture)
+// from 0.0-1.0 onto an output value from 0.0-1.0.  The builtin curves
+// are functions, the ones in velocitycurves.json are breakpoint tables.
+type VelocityCurve struct {
+	Name   string       `json:"name"`
+	Points [][2]float32 `json:"points"` // input and output, in increasing order of input
+	fn     func(float32) float32
+}
+
+// builtinVelocityCurves are always available, and can't be redefined
+var builtinVelocityCurves = []*VelocityCurve{
+	{Name: "linear", fn: func(v float32) float32 { return v }},
+	{Name: "exponential", fn: func(v float32) float32 { return v * v }},
+	{Name: "logarithmic", fn: func(v float32) float32 {
+		return float32(math.Log(1.0+9.0*float64(v)) / math.Log(10.0))
+	}},
+	{Name: "scurve", fn: func(v float32) float32 { return v * v * (3.0 - 2.0*v) }},
+}
+
+// VelocityCurves maps a name to a VelocityCurve
+var VelocityCurves = velocityCurveMap(nil)
+
+// VelocityCurveNames are the names of the curves, builtins first
+var VelocityCurveNames = velocityCurveNames(nil)
+
+var velocityCurvesMutex sync.RWMutex
+
+func velocityCurveMap(loaded []*VelocityCurve) map[string]*VelocityCurve {
+	m := make(map[string]*VelocityCurve)
+	for _, c := range builtinVelocityCurves {
+		m[c.Name] = c
+	}
+	for _, c := range loaded {
+		m[c.Name] = c
+	}
+	return m
+}
+
+func velocityCurveNames(loaded []*VelocityCurve) []string {
+	names := make([]string, 0, len(builtinVelocityCurves)+len(loaded))
+	for _, c := range builtinVelocityCurves {
+		names = append(names, c.Name)
+	}
+	for _, c := range loaded {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// LoadVelocityCurves reads the user-defined curves in velocitycurves.json
+func LoadVelocityCurves() error {
+
+	path := ConfigFilePath("velocitycurves.json")
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("LoadVelocityCurves: unable to read path=%s", path)
+	}
+	var f struct {
+		Curves []*VelocityCurve `json:"curves"`
+	}
+	err = json.Unmarshal(bytes, &f)
+	if err != nil {
+		return fmt.Errorf("LoadVelocityCurves: unable to Unmarshal path=%s, err=%s", path, err)
+	}
+	builtin := velocityCurveMap(nil)
+	for _, c := range f.Curves {
+		if c.Name == "" || builtin[c.Name] != nil {
+			return fmt.Errorf("LoadVelocityCurves: invalid curve name (%s) in path=%s", c.Name, path)
+		}
+		if len(c.Points) < 2 {
+			return fmt.Errorf("LoadVelocityCurves: curve %s needs at least 2 points", c.Name)
+		}
+		for i, pt := range c.Points {
+			if pt[0] < 0.0 || pt[0] > 1.0 || pt[1] < 0.0 || pt[1] > 1.0 {
+				return fmt.Errorf("LoadVelocityCurves: curve %s has a point outside 0.0-1.0", c.Name)
+			}
+			if i > 0 && pt[0] <= c.Points[i-1][0] {
+				return fmt.Errorf("LoadVelocityCurves: curve %s points aren't in increasing order", c.Name)
+			}
+		}
+	}
+
+	velocityCurvesMutex.Lock()
+	VelocityCurves = velocityCurveMap(f.Curves)
+	VelocityCurveNames = velocityCurveNames(f.Curves)
+	velocityCurvesMutex.Unlock()
+
+	SetParamEnum("velocitycurve", velocityCurveEnum())
+	return nil
+}
+
+// velocityCurveEnum returns the values of the sound.velocitycurve parameter
+func velocityCurveEnum() []string {
+	velocityCurvesMutex.RLock()
+	defer velocityCurvesMutex.RUnlock()
+	return append([]string{}, VelocityCurveNames...)
+}
+
+// GetVelocityCurve returns the named curve
+func GetVelocityCurve(name string) (*VelocityCurve, error) {
+	velocityCurvesMutex.RLock()
+	defer velocityCurvesMutex.RUnlock()
+	c, ok := VelocityCurves[name]
+	if !ok {
+		return nil, fmt.Errorf("no velocity curve named %s", name)
+	}
+	return c, nil
+}
+
+// Apply returns the output of the curve for v, which is clamped to 0.0-1.0
+func (c *VelocityCurve) Apply(v float32) float32 {
+	v = clamp01(v)
+	if c.fn != nil {
+		return clamp01(c.fn(v))
+	}
+	pts := c.Points
+	if v <= pts[0][0] {
+		return pts[0][1]
+	}
+	for i := 1; i < len(pts); i++ {
+		if v <= pts[i][0] {
+			p0 := pts[i-1]
+			p1 := pts[i]
+			return p0[1] + (p1[1]-p0[1])*(v-p0[0])/(p1[0]-p0[0])
+		}
+	}
+	return pts[len(pts)-1][1]
+}
+
+func clamp01(v float32) float32 {
+	if v < 0.0 {
+		return 0.0
+	}
+	if v > 1.0 {
+		return 1.0
+	}
+	return v
+}
+
+// velocityInRange maps v (0.0-1.0) onto velocitymin-velocitymax
+func velocityInRange(v float32, velocitymin, velocitymax int) uint8 {
+	if velocitymin == 0 && velocitymax == 0 {
+		// bogus, when values in json are missing
+		velocitymax = 127
+	}
+	if velocitymin > velocitymax {
+		velocitymin, velocitymax = velocitymax, velocitymin
+	}
+	vel := velocitymin + int(clamp01(v)*float32(velocitymax-velocitymin)+0.5)
+	if vel > 127 {
+		vel = 127
+	}
+	return uint8(vel)
+}
+
+// cursorVolValue returns the value (0.0-1.0) that drives the velocity
+// of a gesture, before any curve is applied.  curved is false
+// if the value is fixed, i.e. the curve shouldn't apply.
+func (r *Reactor) cursorVolValue(ce GestureStepEvent) (v float32, curved bool) {
+	vol := r.params.ParamStringValue("misc.vol", "fixed")
+	switch vol {
+	case "frets":
+		return 1.0 - ce.Y, true
+	case "pressure":
+		return ce.Z * r.params.ParamFloatValue("sound.pressurescale"), true
+	case "fixed":
+		return 0.8, false
+	default:
+		log.Printf("Unrecognized vol value: %s, assuming fixed\n", vol)
+		return 0.8, false
+	}
+}
+
+// velocityOf applies the region's velocity curve and range to v
+func (r *Reactor) velocityOf(v float32, curveName string) (uint8, error) {
+	curve, err := GetVelocityCurve(curveName)
+	if err != nil {
+		return 0, err
+	}
+	return velocityInRange(curve.Apply(v),
+		r.params.ParamIntValue("sound.velocitymin"),
+		r.params.ParamIntValue("sound.velocitymax")), nil
+}
+
+// velocityPreview returns the velocity that this region would produce
+// for a given input value, using its curve or the one given in the args
+func (r *Reactor) velocityPreview(api string, args map[string]string) (string, error) {
+	v, err := NeedFloatArg("value", api, args)
+	if err != nil {
+		return "", err
+	}
+	curveName := OptionalStringArg("curve", args, r.params.ParamStringValue("sound.velocitycurve", "linear"))
+	vel, err := r.velocityOf(v, curveName)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(int(vel)), nil
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// voice is a NOTEON that's currently sounding
+type voice struct {
+	pitch    uint8
+	velocity uint8
+	sound    string
+	order    int // when it started, for stealing the oldest
+}
+
+// VoiceStatus is the result of the voice_status API
+type VoiceStatus struct {
+	Region     string `json:"region"`
+	Polyphony  int    `json:"polyphony"` // 0 is unlimited
+	Steal      string `json:"steal"`
+	Sounding   int    `json:"sounding"`
+	Peak       int    `json:"peak"`
+	NotesOn    int    `json:"noteson"`
+	Stolen     int    `json:"stolen"`
+	Suppressed int    `json:"suppressed"` // NOTEOFFs of stolen voices that weren't sent
+}
+
+// voiceAllocator limits the number of notes sounding in a region,
+// stealing voices when the limit is reached
+type voiceAllocator struct {
+	mutex      sync.Mutex
+	voices     []*voice
+	order      int
+	stolenOffs map[string]int // NOTEOFFs still expected for stolen voices, key is voiceKey
+	peak       int
+	notesOn    int
+	stolen     int
+	suppressed int
+}
+
+func newVoiceAllocator() *voiceAllocator {
+	return &voiceAllocator{
+		stolenOffs: make(map[string]int),
+	}
+}
+
+func voiceKey(sound string, pitch uint8) string {
+	return fmt.Sprintf("%s.%d", sound, pitch)
+}
+
+// noteOn adds a voice, and returns the voices (if any) that were stolen to make room for it.
+// More than one is stolen if the polyphony was lowered while notes were sounding.
+func (va *voiceAllocator) noteOn(n *Note, polyphony int, steal string) []*voice {
+	va.mutex.Lock()
+	defer va.mutex.Unlock()
+
+	var victims []*voice
+	for polyphony > 0 && len(va.voices) >= polyphony {
+		vi := va.victimIndex(steal)
+		victim := va.voices[vi]
+		va.voices = append(va.voices[:vi], va.voices[vi+1:]...)
+		va.stolenOffs[voiceKey(victim.sound, victim.pitch)]++
+		va.stolen++
+		victims = append(victims, victim)
+	}
+	va.order++
+	va.voices = append(va.voices, &voice{pitch: n.Pitch, velocity: n.Velocity, sound: n.Sound, order: va.order})
+	va.notesOn++
+	if len(va.voices) > va.peak {
+		va.peak = len(va.voices)
+	}
+	return victims
+}
+
+// victimIndex returns the index of the voice to steal
+func (va *voiceAllocator) victimIndex(steal string) int {
+	vi := 0
+	for i, v := range va.voices {
+		best := va.voices[vi]
+		switch steal {
+		case "quietest":
+			if v.velocity < best.velocity {
+				vi = i
+			}
+		case "lowest":
+			if v.pitch < best.pitch {
+				vi = i
+			}
+		case "highest":
+			if v.pitch > best.pitch {
+				vi = i
+			}
+		default: // "oldest"
+			if v.order < best.order {
+				vi = i
+			}
+		}
+	}
+	return vi
+}
+
+// noteOff removes a voice, and returns false if the NOTEOFF
+// shouldn't be sent because its voice was already stolen
+func (va *voiceAllocator) noteOff(n *Note) bool {
+	va.mutex.Lock()
+	defer va.mutex.Unlock()
+
+	key := voiceKey(n.Sound, n.Pitch)
+	if va.stolenOffs[key] > 0 {
+		va.stolenOffs[key]--
+		if va.stolenOffs[key] == 0 {
+			delete(va.stolenOffs, key)
+		}
+		va.suppressed++
+		return false
+	}
+	// Remove the oldest voice with the same pitch and sound
+	for i, v := range va.voices {
+		if v.pitch == n.Pitch && v.sound == n.Sound {
+			va.voices = append(va.voices[:i], va.voices[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// clear forgets all the voices, e.g. after an all-notes-off
+func (va *voiceAllocator) clear() {
+	va.mutex.Lock()
+	defer va.mutex.Unlock()
+	va.voices = nil
+	va.stolenOffs = make(map[string]int)
+}
+
+// sendNote sends a Note from the region, applying its polyphony limit
+func (r *Reactor) sendNote(n *Note) {
+	switch {
+	case n.TypeOf == NOTEON && n.Velocity > 0:
+		victims := r.voices.noteOn(n,
+			r.params.ParamIntValue("sound.polyphony"),
+			r.params.ParamStringValue("sound.voicesteal", "oldest"))
+		for _, victim := range victims {
+			if DebugUtil.MIDI {
+				log.Printf("Reactor.sendNote: region=%s stealing pitch=%d sound=%s\n", r.padName, victim.pitch, victim.sound)
+			}
+			r.sendTunedNote(NewNoteOff(victim.pitch, 0, victim.sound))
+		}
+	case n.TypeOf == NOTEOFF || n.TypeOf == NOTEON:
+		if !r.voices.noteOff(n) {
+			return
+		}
+	}
+	r.sendTunedNote(n)
+}
+
+// voiceStatus is the result of the voice_status API
+func (r *Reactor) voiceStatus() (string, error) {
+	va := r.voices
+	va.mutex.Lock()
+	status := VoiceStatus{
+		Region:     r.padName,
+		Polyphony:  r.params.ParamIntValue("sound.polyphony"),
+		Steal:      r.params.ParamStringValue("sound.voicesteal", "oldest"),
+		Sounding:   len(va.voices),
+		Peak:       va.peak,
+		NotesOn:    va.notesOn,
+		Stolen:     va.stolen,
+		Suppressed: va.suppressed,
+	}
+	va.mutex.Unlock()
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		return "", fmt.Errorf("Reactor.voiceStatus: err=%s", err)
+	}
+	return string(bytes), nil
+}
+
+// voiceReset forgets the sounding voices (e.g. after a panic)
+// and resets the voice counters
+func (r *Reactor) voiceReset() {
+	r.clearTunedNotes()
+	r.voices.clear()
+	va := r.voices
+	va.mutex.Lock()
+	defer va.mutex.Unlock()
+	va.peak = 0
+	va.notesOn = 0
+	va.stolen = 0
+	va.suppressed = 0
+}
@@ -120,6 +120,11 @@ func (style *Style) RowHeight() int {
 	return style.fontHeight + 2
 }
 
+// FontFace xxx
+func (style *Style) FontFace() font.Face {
+	return style.fontFace
+}
+
 // BoundString xxx
 func (style *Style) BoundString(s string) image.Rectangle {
 	return text.BoundString(style.fontFace, s)
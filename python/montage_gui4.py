@@ -703,7 +703,7 @@ class ProGuiApp(tk.Tk):
                 self.editPage["snap"].setChanged()
                 self.sendPadParamValue(self.PadName,paramname,newval)
 
-        if self.showSliders:
+        if self.showSliders and paramname[7:] == "param":
             i = sliderIndexOfParam(paramname)
             if i != None:
                 self.performPage[self.currentPerformPageName].sliderNameChanged(newval,i)
@@ -1130,6 +1130,13 @@ class ProGuiApp(tk.Tk):
 
         self.paramenums["sliderParam"] = self.allParamNames
 
+        # The scales are the ones in scales.json, as in the engine
+        j = montage.readJsonPath(montage.configFilePath("scales.json"))
+
+        self.paramenums["scale"] = ["external"]
+        for o in j["scales"]:
+            self.paramenums["scale"].append(o["name"])
+
     # XXX - Someday, convert all the code to eliminate this.
     def convertParamdefsToParams(self,newparamsjson):
         # This silliness is to avoid needing to convert all the other
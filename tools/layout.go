@@ -0,0 +1,131 @@
+package tools
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/vizicist/montage/engine"
+	"github.com/vizicist/montage/gui"
+)
+
+// Layout is a window that shows the layout of pitches in a region
+type Layout struct {
+	ctx     gui.WinContext
+	region  string
+	buttons []gui.Window
+}
+
+// NewLayout xxx
+func NewLayout(parent gui.Window) gui.ToolData {
+
+	layout := &Layout{
+		ctx:    gui.NewWindowContext(parent),
+		region: "A",
+	}
+
+	for _, region := range []string{"A", "B", "C", "D"} {
+		layout.buttons = append(layout.buttons, gui.AddChild(layout, gui.NewButton(layout, region)))
+	}
+
+	return gui.NewToolData(layout, "Layout", image.Point{})
+}
+
+// Context xxx
+func (layout *Layout) Context() *gui.WinContext {
+	return &layout.ctx
+}
+
+// Do xxx
+func (layout *Layout) Do(cmd string, arg interface{}) (interface{}, error) {
+
+	switch cmd {
+	case "mouse":
+		gui.WinForwardMouse(layout, gui.ToMouse(arg))
+	case "resize":
+		layout.resize()
+	case "redraw":
+		layout.redraw()
+	case "restore":
+		state, ok := arg.(map[string]interface{})
+		if ok {
+			if region, ok := state["region"]; ok {
+				layout.region = gui.ToString(region)
+			}
+		}
+
+	case "dumpstate":
+		return fmt.Sprintf("{ \"region\": \"%s\" }", layout.region), nil
+
+	case "close":
+		// do nothing
+
+	case "buttondown":
+		// The buttons select the region
+		layout.region = gui.ToString(arg)
+	case "buttonup":
+		//
+	default:
+		gui.DoUpstream(layout, cmd, arg)
+	}
+	return nil, nil
+}
+
+func (layout *Layout) buttonHeight() int {
+	return gui.WinStyle(layout).TextHeight() + 12
+}
+
+// Resize xxx
+func (layout *Layout) resize() {
+
+	mySize := gui.WinCurrSize(layout)
+	buttWidth := mySize.X / 4
+	buttSize := image.Point{buttWidth, layout.buttonHeight()}
+
+	pos := image.Point{2, 2}
+	for _, w := range layout.buttons {
+		gui.WinSetChildPos(layout, w, pos)
+		gui.WinSetChildSize(w, buttSize)
+		// Advance the horizontal position for the next button
+		pos = pos.Add(image.Point{buttWidth, 0})
+	}
+}
+
+// Draw xxx
+func (layout *Layout) redraw() {
+	size := gui.WinCurrSize(layout)
+	rect := image.Rect(0, 0, size.X, size.Y)
+	gui.DoUpstream(layout, "setcolor", gui.BackColor)
+	gui.DoUpstream(layout, "drawfilledrect", rect.Inset(1))
+	gui.DoUpstream(layout, "setcolor", gui.ForeColor)
+	gui.DoUpstream(layout, "drawrect", rect)
+	gui.RedrawChildren(layout)
+
+	desc, err := engine.TheRouter().RegionLayout(layout.region)
+	if err != nil {
+		return
+	}
+
+	// The grid goes below the buttons, with y going up like it does on the surface
+	style := gui.WinStyle(layout)
+	area := image.Rect(2, layout.buttonHeight()+4, size.X-2, size.Y-2)
+	w := float32(area.Dx())
+	h := float32(area.Dy())
+	for _, cell := range desc.Cells {
+		cellRect := image.Rect(
+			area.Min.X+int(cell.X0*w), area.Max.Y-int(cell.Y1*h),
+			area.Min.X+int(cell.X1*w), area.Max.Y-int(cell.Y0*h))
+		cellRect = cellRect.Intersect(area)
+		if cell.InScale {
+			gui.DoUpstream(layout, "setcolor", gui.ForeColor)
+		} else {
+			gui.DoUpstream(layout, "setcolor", gui.RedColor)
+		}
+		gui.DoUpstream(layout, "drawrect", cellRect)
+		// Only label the cells that have room for it
+		if style.TextWidth(cell.Name)+4 <= cellRect.Dx() && style.TextHeight()+4 <= cellRect.Dy() {
+			labelPos := cellRect.Min.Add(image.Point{2, style.TextHeight()})
+			gui.DoUpstream(layout, "drawtext", gui.DrawTextCmd{Text: cell.Name, Face: style.FontFace(), Pos: labelPos})
+		}
+	}
+	gui.DoUpstream(layout, "setcolor", gui.ForeColor)
+}